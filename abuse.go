@@ -0,0 +1,229 @@
+package dht
+
+import (
+	"expvar"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/golang/groupcache/lru"
+)
+
+/*
+	防滥用。
+	nettools.ClientThrottle按单个IP限制每分钟的包数，但攻击者很容易换用同一个网段里的其他地址，
+	所以这里再按网段(IPv4是/24，IPv6是/64)限制每分钟的包数。
+	发送无法解码的bencode或者错误token的主机会被记一次strike，在strikeWindow内strike达到
+	AbuseBanThreshold次就会被封禁AbuseBanDuration，封禁到期后自动解除，也可以通过DHT.Unblock()手动解除。
+	封禁列表可以在其他goroutine中通过DHT.Bans()读取，所以abuseTracker自己加锁。
+ */
+
+const (
+	strikeWindow = 10 * time.Minute
+	maxBans      = 10000 // 封禁列表的上限，防止伪造源地址把内存撑爆
+)
+
+// strike的原因
+const (
+	strikeMalformed = "malformed"
+	strikeBadToken  = "badToken"
+)
+
+// Ban 是一个被封禁的主机。
+type Ban struct {
+	IP      string
+	Reason  string    // 最后一次strike的原因
+	Strikes int       // 封禁前累计的strike次数
+	Until   time.Time // 封禁到期的时间
+}
+
+type abuseCounter struct {
+	n     int
+	since time.Time
+}
+
+// add 在window内累加计数，过了window就重新开始计数。返回当前的计数。
+func (c *abuseCounter) add(now time.Time, window time.Duration) int {
+	if now.Sub(c.since) > window {
+		c.n = 0
+		c.since = now
+	}
+	c.n++
+	return c.n
+}
+
+type abuseTracker struct {
+	mu           sync.Mutex
+	subnets      *lru.Cache // key: 网段, value: *abuseCounter
+	strikes      *lru.Cache // key: IP, value: *abuseCounter
+	bans         map[string]*Ban
+	subnetLimit  int
+	banThreshold int
+	banDuration  time.Duration
+}
+
+func newAbuseTracker(subnetLimit int, banThreshold int, banDuration time.Duration, trackedClients int64) *abuseTracker {
+	return &abuseTracker{
+		subnets:      lru.New(int(trackedClients)),
+		strikes:      lru.New(int(trackedClients)),
+		bans:         make(map[string]*Ban),
+		subnetLimit:  subnetLimit,
+		banThreshold: banThreshold,
+		banDuration:  banDuration,
+	}
+}
+
+// subnetKey 返回ip所在的/24(IPv4)或者/64(IPv6)网段。
+func subnetKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// banned 如果ip正在被封禁，返回true。过期的封禁在这里被删除。
+func (a *abuseTracker) banned(ip net.IP, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b, ok := a.bans[ip.String()]
+	if !ok {
+		return false
+	}
+	if now.After(b.Until) {
+		delete(a.bans, ip.String())
+		return false
+	}
+	return true
+}
+
+// allowSubnet 统计ip所在网段的包数，超过subnetLimit每分钟就返回false。subnetLimit为0或负数时不限制。
+func (a *abuseTracker) allowSubnet(ip net.IP, now time.Time) bool {
+	if a.subnetLimit <= 0 {
+		return true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := subnetKey(ip)
+	var c *abuseCounter
+	if v, ok := a.subnets.Get(key); ok {
+		c = v.(*abuseCounter)
+	} else {
+		c = &abuseCounter{since: now}
+		a.subnets.Add(key, c)
+	}
+	return c.add(now, time.Minute) <= a.subnetLimit
+}
+
+// strike 给ip记一次strike，达到banThreshold次就封禁它。如果这次strike导致封禁，返回true。
+func (a *abuseTracker) strike(ip net.IP, reason string, now time.Time) bool {
+	if a.banThreshold <= 0 {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := ip.String()
+	var c *abuseCounter
+	if v, ok := a.strikes.Get(key); ok {
+		c = v.(*abuseCounter)
+	} else {
+		c = &abuseCounter{since: now}
+		a.strikes.Add(key, c)
+	}
+	n := c.add(now, strikeWindow)
+	if n < a.banThreshold {
+		return false
+	}
+	a.strikes.Remove(key)
+	if len(a.bans) >= maxBans {
+		a.pruneLocked(now)
+		if len(a.bans) >= maxBans {
+			return false
+		}
+	}
+	a.bans[key] = &Ban{IP: key, Reason: reason, Strikes: n, Until: now.Add(a.banDuration)}
+	totalBannedHosts.Add(1)
+	return true
+}
+
+func (a *abuseTracker) pruneLocked(now time.Time) {
+	for k, b := range a.bans {
+		if now.After(b.Until) {
+			delete(a.bans, k)
+		}
+	}
+}
+
+// list 返回所有还没有过期的封禁，按到期时间排序。
+func (a *abuseTracker) list(now time.Time) []Ban {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pruneLocked(now)
+	ret := make([]Ban, 0, len(a.bans))
+	for _, b := range a.bans {
+		ret = append(ret, *b)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Until.Before(ret[j].Until) })
+	return ret
+}
+
+// unblock 解除对ip的封禁并清空它的strike。如果ip之前被封禁，返回true。
+func (a *abuseTracker) unblock(ip string) bool {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.strikes.Remove(ip)
+	_, ok := a.bans[ip]
+	delete(a.bans, ip)
+	return ok
+}
+
+// Bans 返回当前所有的封禁，可以在任何goroutine中调用。
+func (d *DHT) Bans() []Ban {
+	return d.abuse.list(time.Now())
+}
+
+// Unblock 手动解除对ip的封禁。如果ip之前被封禁，返回true。
+func (d *DHT) Unblock(ip string) bool {
+	return d.abuse.unblock(ip)
+}
+
+// checkHost 判断来自ip的包是否应该被处理。被封禁、被ClientThrottle限制或者网段超限的包都会被丢掉。
+func (d *DHT) checkHost(ip net.IP) bool {
+	now := time.Now()
+	if d.blocklist.blocked(ip) {
+		totalPacketsFromBlockedHosts.Add(1)
+		dropPacket(dropBlocklisted)
+		return false
+	}
+	if d.abuse.banned(ip, now) {
+		totalPacketsFromBlockedHosts.Add(1)
+		dropPacket(dropBanned)
+		return false
+	}
+	d.throttleMu.Lock()
+	allowed := d.clientThrottle.CheckBlock(ip.String())
+	d.throttleMu.Unlock()
+	if !allowed {
+		totalPacketsFromBlockedHosts.Add(1)
+		dropPacket(dropThrottled)
+		return false
+	}
+	if !d.abuse.allowSubnet(ip, now) {
+		totalPacketsFromBlockedHosts.Add(1)
+		dropPacket(dropSubnetThrottled)
+		return false
+	}
+	return true
+}
+
+var totalBannedHosts = expvar.NewInt("totalBannedHosts")
+
+func (d *DHT) strikeHost(ip net.IP, reason string) {
+	if d.abuse.strike(ip, reason, time.Now()) {
+		log.V(2).Infof("DHT: banning %v for %v after repeated %v", ip, d.config.AbuseBanDuration, reason)
+	}
+}
@@ -1,5 +1,7 @@
 package dht
 
+import "expvar"
+
 type arena chan []byte
 
 /*
@@ -10,17 +12,67 @@ type arena chan []byte
 	这是基于Write（）和类似函数返回的字节数。
  */
 
+const (
+	minArenaBlocks = 64
+	maxArenaBlocks = 4096
+)
+
 func newArena(blockSize int,numBlocks int) arena {
 	blocks := make(arena,numBlocks)
 	for i := 0;i <numBlocks;i++ {
 		blocks <- make([]byte,blockSize)
 	}
+	arenaBlocks.Add(int64(numBlocks))
 	return blocks
 }
+
+// arenaSize 根据RateLimit计算需要多少个block，大约能容纳一秒钟的包。不限速时用maxArenaBlocks。
+func arenaSize(rateLimit int64) int {
+	if rateLimit <= 0 || rateLimit > maxArenaBlocks {
+		return maxArenaBlocks
+	}
+	if rateLimit < minArenaBlocks {
+		return minArenaBlocks
+	}
+	return int(rateLimit)
+}
+
 func (a arena) Pop() (x []byte) {
-	return <-a
+	x = <-a
+	arenaBlocksInUse.Add(1)
+	return x
 }
+
+// TryPop 和Pop一样，但是arena用完时不等待，直接返回false。
+func (a arena) TryPop() (x []byte,ok bool) {
+	select {
+	case x = <-a:
+		arenaBlocksInUse.Add(1)
+		return x,true
+	default:
+		return nil,false
+	}
+}
+
+// PopWait 和Pop一样，但是在stop被关闭时返回false。
+func (a arena) PopWait(stop chan bool) (x []byte,ok bool) {
+	select {
+	case x = <-a:
+		arenaBlocksInUse.Add(1)
+		return x,true
+	case <-stop:
+		return nil,false
+	}
+}
+
 func (a arena) Push(x []byte) {
 	x = x[:cap(x)]
 	a <- x
+	arenaBlocksInUse.Add(-1)
 }
+
+var (
+	// arenaBlocks是所有arena预先分配的block总数，arenaBlocksInUse是正在被使用的block数。
+	arenaBlocks = expvar.NewInt("arenaBlocks")
+	arenaBlocksInUse = expvar.NewInt("arenaBlocksInUse")
+)
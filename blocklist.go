@@ -0,0 +1,269 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+/*
+	IP黑名单。
+	支持两种文件格式，可以混在同一个文件里，空行和#开头的行被忽略：
+	- PeerGuardian P2P格式： "描述:1.2.3.0-1.2.3.255"
+	- CIDR列表：            "1.2.3.0/24"、"2001:db8::/32"，或者单个IP地址
+	所有的地址都转换成16字节的形式，排序并合并重叠的区间，查找时用二分查找。
+	重新加载时在旁边构建新的rangeSet，然后原子地替换，所以主goroutine在查找时不需要加锁。
+ */
+
+// 多久检查一次黑名单文件是否被修改
+const blocklistCheckPeriod = time.Minute
+
+type ipRange struct {
+	start, end [16]byte
+}
+
+// rangeSet 是排好序、互不重叠的区间列表。
+type rangeSet []ipRange
+
+func (s rangeSet) contains(ip net.IP) bool {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false
+	}
+	var k [16]byte
+	copy(k[:], ip16)
+	// 找到第一个end >= ip的区间，再看它的start是否 <= ip。
+	i := sort.Search(len(s), func(i int) bool {
+		return bytes.Compare(s[i].end[:], k[:]) >= 0
+	})
+	return i < len(s) && bytes.Compare(s[i].start[:], k[:]) <= 0
+}
+
+// mergeRanges 排序并合并重叠或者相邻的区间。
+func mergeRanges(r []ipRange) rangeSet {
+	if len(r) == 0 {
+		return nil
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return bytes.Compare(r[i].start[:], r[j].start[:]) < 0
+	})
+	out := rangeSet{r[0]}
+	for _, x := range r[1:] {
+		last := &out[len(out)-1]
+		next := last.end
+		// next = last.end + 1，用来判断是否相邻
+		for i := 15; i >= 0; i-- {
+			next[i]++
+			if next[i] != 0 {
+				break
+			}
+		}
+		if bytes.Compare(x.start[:], next[:]) <= 0 || bytes.Compare(x.start[:], last.end[:]) <= 0 {
+			if bytes.Compare(x.end[:], last.end[:]) > 0 {
+				last.end = x.end
+			}
+			continue
+		}
+		out = append(out, x)
+	}
+	return out
+}
+
+func to16(ip net.IP) (k [16]byte, ok bool) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return k, false
+	}
+	copy(k[:], ip16)
+	return k, true
+}
+
+// parseBlocklistLine 解析一行P2P或者CIDR格式的记录。
+func parseBlocklistLine(line string) (ipRange, error) {
+	// 先试P2P格式。描述中可能有冒号和斜杠，所以把最后一个冒号之后的部分当作区间。
+	if i := strings.LastIndex(line, ":"); i >= 0 {
+		if r, err := parseIPRange(line[i+1:]); err == nil {
+			return r, nil
+		}
+	}
+	if strings.Contains(line, "/") {
+		_, n, err := net.ParseCIDR(line)
+		if err != nil {
+			return ipRange{}, err
+		}
+		var r ipRange
+		start, _ := to16(n.IP)
+		r.start, r.end = start, start
+		ones, bits := n.Mask.Size()
+		// 把主机位全部置1得到区间的结束地址
+		for i := ones + (128 - bits); i < 128; i++ {
+			r.end[i/8] |= 1 << uint(7-i%8)
+		}
+		return r, nil
+	}
+	if ip := net.ParseIP(line); ip != nil {
+		k, _ := to16(ip)
+		return ipRange{k, k}, nil
+	}
+	// 没有描述的区间
+	return parseIPRange(line)
+}
+
+func parseIPRange(s string) (ipRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return ipRange{}, fmt.Errorf("invalid blocklist range %q", s)
+	}
+	start, ok1 := to16(net.ParseIP(strings.TrimSpace(parts[0])))
+	end, ok2 := to16(net.ParseIP(strings.TrimSpace(parts[1])))
+	if !ok1 || !ok2 {
+		return ipRange{}, fmt.Errorf("invalid blocklist range %q", s)
+	}
+	if bytes.Compare(start[:], end[:]) > 0 {
+		start, end = end, start
+	}
+	return ipRange{start, end}, nil
+}
+
+// readBlocklist 读取一个黑名单文件。格式不对的行被跳过并计数，不会让整个文件失效。
+func readBlocklist(r io.Reader, name string) ([]ipRange, error) {
+	var ranges []ipRange
+	scanner := bufio.NewScanner(r)
+	lineNo, bad := 0, 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rng, err := parseBlocklistLine(line)
+		if err != nil {
+			bad++
+			log.V(1).Infof("DHT: blocklist %v:%d: %v", name, lineNo, err)
+			continue
+		}
+		ranges = append(ranges, rng)
+	}
+	if bad > 0 {
+		blocklistBadLines.Add(int64(bad))
+		log.Warningf("DHT: blocklist %v: skipped %d malformed lines", name, bad)
+	}
+	return ranges, scanner.Err()
+}
+
+// blocklist 持有当前生效的rangeSet和它的来源文件，nil的blocklist什么都不拦截。
+type blocklist struct {
+	paths    []string
+	ranges   atomic.Value // rangeSet
+	mu       sync.Mutex   // 保证同一时间只有一个reload
+	modTimes map[string]time.Time
+}
+
+// newBlocklist 加载逗号分隔的文件列表。
+func newBlocklist(paths string) (*blocklist, error) {
+	b := &blocklist{modTimes: make(map[string]time.Time)}
+	for _, p := range strings.Split(paths, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			b.paths = append(b.paths, p)
+		}
+	}
+	if err := b.reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *blocklist) blocked(ip net.IP) bool {
+	if b == nil {
+		return false
+	}
+	return b.ranges.Load().(rangeSet).contains(ip)
+}
+
+// reload 重新读取所有文件。任何一个文件打不开或者读取出错，旧的rangeSet保持不变，格式不对的行只是被跳过。
+func (b *blocklist) reload() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var all []ipRange
+	modTimes := make(map[string]time.Time)
+	for _, p := range b.paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("blocklist: %v", err)
+		}
+		if st, err := f.Stat(); err == nil {
+			modTimes[p] = st.ModTime()
+		}
+		ranges, err := readBlocklist(f, p)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("blocklist: %v", err)
+		}
+		all = append(all, ranges...)
+	}
+	set := mergeRanges(all)
+	b.ranges.Store(set)
+	b.modTimes = modTimes
+	blocklistRanges.Set(int64(len(set)))
+	return nil
+}
+
+// changed 如果有文件的修改时间变了，返回true。
+func (b *blocklist) changed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, p := range b.paths {
+		st, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		if !st.ModTime().Equal(b.modTimes[p]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReloadBlocklist 立即重新加载Config.Blocklist中的文件，可以在任何goroutine中调用。
+// 已经在路由表中的被拦截的节点会在下一次检查黑名单时被删除。
+func (d *DHT) ReloadBlocklist() error {
+	if d.blocklist == nil {
+		return fmt.Errorf("no blocklist configured")
+	}
+	return d.blocklist.reload()
+}
+
+// checkBlocklist 在主goroutine中定期调用，文件被修改时重新加载，并把被拦截的节点从路由表中删除。
+func (d *DHT) checkBlocklist() {
+	if d.blocklist == nil {
+		return
+	}
+	if d.blocklist.changed() {
+		if err := d.blocklist.reload(); err != nil {
+			log.Warningf("DHT: %v", err)
+			return
+		}
+		log.V(1).Infof("DHT: reloaded blocklist")
+	}
+	for _, n := range d.routingTable.addresses {
+		if d.blocklist.blocked(n.address.IP) {
+			d.routingTable.kill(n, d.peerStore)
+		}
+	}
+}
+
+var (
+	blocklistRanges   = expvar.NewInt("blocklistRanges")
+	blocklistBadLines = expvar.NewInt("blocklistBadLines")
+)
@@ -0,0 +1,202 @@
+package dht
+
+import (
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func mustRange(t *testing.T, line string) ipRange {
+	t.Helper()
+	r, err := parseBlocklistLine(line)
+	if err != nil {
+		t.Fatalf("%q: %v", line, err)
+	}
+	return r
+}
+
+func TestParseBlocklistLine(t *testing.T) {
+	tests := []struct {
+		line       string
+		start, end string
+	}{
+		{"Some ISP:1.2.3.0-1.2.3.255", "1.2.3.0", "1.2.3.255"},
+		{"desc with: colons and / slashes:10.0.0.1-10.0.0.9", "10.0.0.1", "10.0.0.9"},
+		{"reversed:10.0.0.9-10.0.0.1", "10.0.0.1", "10.0.0.9"},
+		{"spaces: 10.0.0.1 - 10.0.0.2", "10.0.0.1", "10.0.0.2"},
+		{"1.2.3.0/24", "1.2.3.0", "1.2.3.255"},
+		{"1.2.3.4/32", "1.2.3.4", "1.2.3.4"},
+		{"1.2.3.77/30", "1.2.3.76", "1.2.3.79"},
+		{"0.0.0.0/0", "0.0.0.0", "255.255.255.255"},
+		{"2001:db8::/32", "2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{"2001:db8::1/128", "2001:db8::1", "2001:db8::1"},
+		{"1.2.3.4", "1.2.3.4", "1.2.3.4"},
+		{"2001:db8::1", "2001:db8::1", "2001:db8::1"},
+		{"10.0.0.1-10.0.0.2", "10.0.0.1", "10.0.0.2"},
+		{"2001:db8::1-2001:db8::ff", "2001:db8::1", "2001:db8::ff"},
+	}
+	for _, tt := range tests {
+		r := mustRange(t, tt.line)
+		start, _ := to16(net.ParseIP(tt.start))
+		end, _ := to16(net.ParseIP(tt.end))
+		if r.start != start || r.end != end {
+			t.Errorf("%q: got %v-%v, want %v-%v", tt.line, net.IP(r.start[:]), net.IP(r.end[:]), tt.start, tt.end)
+		}
+	}
+}
+
+func TestParseBlocklistLineRejects(t *testing.T) {
+	for _, line := range []string{
+		"hello",
+		"desc:1.2.3-1.2.3.4",
+		"desc:1.2.3.4-",
+		"desc:1.2.3.4-x",
+		"1.2.3.0/33",
+		"1.2.3.0/",
+		"2001:db8::/129",
+		"1.2.3.256",
+		"-",
+	} {
+		if r, err := parseBlocklistLine(line); err == nil {
+			t.Errorf("%q: got %v-%v, want an error", line, net.IP(r.start[:]), net.IP(r.end[:]))
+		}
+	}
+}
+
+func blocklistSet(t *testing.T, lines ...string) rangeSet {
+	t.Helper()
+	var r []ipRange
+	for _, l := range lines {
+		r = append(r, mustRange(t, l))
+	}
+	return mergeRanges(r)
+}
+
+func TestRangeSetContains(t *testing.T) {
+	s := blocklistSet(t, "10.0.0.10-10.0.0.20", "192.168.1.0/24", "2001:db8::/32", "8.8.8.8")
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.9", false},
+		{"10.0.0.10", true},
+		{"10.0.0.15", true},
+		{"10.0.0.20", true},
+		{"10.0.0.21", false},
+		{"192.168.0.255", false},
+		{"192.168.1.0", true},
+		{"192.168.1.255", true},
+		{"192.168.2.0", false},
+		{"8.8.8.7", false},
+		{"8.8.8.8", true},
+		{"8.8.8.9", false},
+		{"2001:db7:ffff:ffff:ffff:ffff:ffff:ffff", false},
+		{"2001:db8::", true},
+		{"2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", true},
+		{"2001:db9::", false},
+		{"::", false},
+		{"255.255.255.255", false},
+		// IPv4映射的IPv6地址和IPv4地址是同一个key。
+		{"::ffff:10.0.0.10", true},
+	}
+	for _, tt := range tests {
+		if got := s.contains(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if s.contains(nil) || rangeSet(nil).contains(net.ParseIP("10.0.0.10")) {
+		t.Error("nil IP or empty set")
+	}
+}
+
+func TestMergeRanges(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{"overlapping", []string{"10.0.0.1-10.0.0.10", "10.0.0.5-10.0.0.20"}, []string{"10.0.0.1-10.0.0.20"}},
+		{"adjacent", []string{"10.0.0.11-10.0.0.20", "10.0.0.1-10.0.0.10"}, []string{"10.0.0.1-10.0.0.20"}},
+		{"adjacent across an octet", []string{"10.0.0.0/24", "10.0.1.0/24"}, []string{"10.0.0.0-10.0.1.255"}},
+		{"gap of one address", []string{"10.0.0.1-10.0.0.10", "10.0.0.12-10.0.0.20"}, []string{"10.0.0.1-10.0.0.10", "10.0.0.12-10.0.0.20"}},
+		{"contained", []string{"10.0.0.0/8", "10.1.2.3", "10.2.0.0/16"}, []string{"10.0.0.0-10.255.255.255"}},
+		{"duplicates", []string{"10.0.0.1", "10.0.0.1"}, []string{"10.0.0.1-10.0.0.1"}},
+		{"chain", []string{"10.0.0.1", "10.0.0.3", "10.0.0.2"}, []string{"10.0.0.1-10.0.0.3"}},
+		{"last address", []string{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:fff0/124", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff00/120"},
+			[]string{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff00-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"}},
+		{"IPv4 and IPv6", []string{"2001:db8::/32", "10.0.0.0/8"}, []string{"10.0.0.0-10.255.255.255", "2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"}},
+	}
+	for _, tt := range tests {
+		s := blocklistSet(t, tt.lines...)
+		var got []string
+		for _, r := range s {
+			got = append(got, net.IP(r.start[:]).String()+"-"+net.IP(r.end[:]).String())
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if mergeRanges(nil) != nil {
+		t.Error("empty input")
+	}
+}
+
+func TestReadBlocklist(t *testing.T) {
+	file := strings.Join([]string{
+		"# comment",
+		"",
+		"Some ISP:1.2.3.0-1.2.3.255",
+		"not a range",
+		"  10.0.0.0/8  ",
+		"desc:1.2.3-1.2.3.4",
+		"2001:db8::1",
+	}, "\n")
+	before := blocklistBadLines.Value()
+	ranges, err := readBlocklist(strings.NewReader(file), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 3 {
+		t.Fatalf("got %d ranges, want 3", len(ranges))
+	}
+	if got := blocklistBadLines.Value() - before; got != 2 {
+		t.Fatalf("bad lines: got %d, want 2", got)
+	}
+}
+
+func TestBlocklistReload(t *testing.T) {
+	p := path.Join(t.TempDir(), "blocklist")
+	if err := os.WriteFile(p, []byte("1.2.3.4\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := newBlocklist(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.blocked(net.ParseIP("1.2.3.4")) || b.blocked(net.ParseIP("5.6.7.8")) {
+		t.Fatal("initial load")
+	}
+	if err := os.WriteFile(p, []byte("5.6.7.8\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if b.blocked(net.ParseIP("1.2.3.4")) || !b.blocked(net.ParseIP("5.6.7.8")) {
+		t.Fatal("reload")
+	}
+	// 文件不见了时保留旧的区间。
+	os.Remove(p)
+	if err := b.reload(); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+	if !b.blocked(net.ParseIP("5.6.7.8")) {
+		t.Fatal("old ranges were dropped")
+	}
+	var nb *blocklist
+	if nb.blocked(net.ParseIP("5.6.7.8")) {
+		t.Fatal("nil blocklist")
+	}
+}
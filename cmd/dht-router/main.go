@@ -0,0 +1,62 @@
+// dht-router 运行一个DHT引导路由器，类似router.bittorrent.com，可以给私有的swarm当作引导节点。
+//
+// 用法：
+//
+//	dht-router -port 6881 -routers "" -debugAddr localhost:8711
+//
+// 所有的flag和dht.RegisterFlags注册的一样，-router总是打开的。收到SIGINT或者SIGTERM时保存路由表并退出。
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/jianhuaixie/dht"
+)
+
+var statsPeriod = flag.Duration("statsPeriod", time.Minute, "How often to log routing table statistics. 0 disables it.")
+
+func main() {
+	cfg := dht.NewConfig()
+	cfg.Port = 6881
+	dht.RegisterFlags(cfg)
+	flag.Parse()
+	cfg.RouterMode = true
+
+	d, err := dht.New(cfg)
+	if err != nil {
+		log.Exitf("dht-router: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		log.Exitf("dht-router: %v", err)
+	}
+	log.Infof("dht-router: listening on UDP port %d", d.Port())
+
+	var stats <-chan time.Time
+	if *statsPeriod > 0 {
+		t := time.NewTicker(*statsPeriod)
+		defer t.Stop()
+		stats = t.C
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	for {
+		select {
+		case <-stats:
+			s := d.TableStats()
+			log.Infof("dht-router: %d nodes, %d reachable", s.Nodes, s.Reachable)
+		case <-sig:
+			log.Infof("dht-router: shutting down")
+			if cfg.SaveRoutingTable {
+				d.Save()
+			}
+			d.Stop()
+			log.Flush()
+			return
+		}
+	}
+}
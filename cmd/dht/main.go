@@ -0,0 +1,289 @@
+// dht 是一个基于dht包的命令行工具，用来在BitTorrent DHT网络中查找peer、ping节点、宣布下载等。
+//
+// 用法：
+//
+//	dht [flags] get-peers <infohash|magnet>
+//	dht [flags] ping <host:port>
+//	dht [flags] find-node <id>
+//	dht [flags] announce <infohash|magnet> <port>
+//	dht [flags] sample <host:port>
+//	dht [flags] serve
+//	dht [flags] crawl
+//
+// 除了serve和crawl，每个命令都在标准输出打印一个JSON对象。crawl每发现一个infohash或者peer就打印一行JSON，直到被中断。输出中的infohash和节点ID都是40个十六进制字符，输入的infohash还可以是base32、64个十六进制字符的v2 infohash或者magnet链接(见dht.ParseInfoHash)。
+// DHT的配置和dht.RegisterFlags注册的flag一样，例如-routers、-stateDir和-debugAddr。
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/jianhuaixie/dht"
+)
+
+var (
+	timeout = flag.Duration("timeout", 30*time.Second, "How long to wait for results before giving up.")
+	numPeers = flag.Int("peers", 0, "get-peers and announce stop after finding this many peers. 0 uses the library default.")
+)
+
+const researchPeriod = 5 * time.Second
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [flags] <command> [args]
+
+Commands:
+  get-peers <infohash|magnet>        find peers for a torrent
+  ping <host:port>                   ping a DHT node
+  find-node <id>                     find the nodes closest to a node ID
+  announce <infohash|magnet> <port>  announce that we download a torrent on a TCP port
+  sample <host:port>                 ask a node for a sample of its infohashes (BEP 51)
+  serve                              run a DHT node until interrupted
+  crawl                              crawl the DHT and print discovered infohashes and peers as JSON lines
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	// 不用dht.DefaultConfig，下面对cfg的修改不应该影响包里的全局变量。
+	cfg := dht.NewConfig()
+	dht.RegisterFlags(cfg)
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if *numPeers > 0 {
+		cfg.NumTargetPeers = *numPeers
+	}
+
+	var run func(d *dht.DHT, cfg *dht.Config, args []string) (interface{}, error)
+	nargs := 1
+	switch args[0] {
+	case "get-peers":
+		run = getPeers
+	case "ping":
+		run = ping
+	case "find-node":
+		run = findNode
+	case "announce":
+		run, nargs = announce, 2
+		if len(args) == 3 {
+			port, err := strconv.Atoi(args[2])
+			if err != nil || port <= 0 || port > 65535 {
+				fatalf("invalid port %q", args[2])
+			}
+			cfg.AnnouncePort = port
+		}
+	case "sample":
+		run = sample
+	case "serve":
+		run, nargs = serve, 0
+	case "crawl":
+		run, nargs = serve, 0
+		cfg.CrawlerMode = true
+	default:
+		fatalf("unknown command %q", args[0])
+	}
+	if len(args)-1 != nargs {
+		fatalf("%s expects %d argument(s), got %d", args[0], nargs, len(args)-1)
+	}
+
+	d, err := dht.New(cfg)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if cfg.CrawlerMode {
+		d.Sink = jsonSink{json.NewEncoder(os.Stdout)}
+	}
+	if err := d.Start(); err != nil {
+		fatalf("%v", err)
+	}
+	ret, err := run(d, cfg, args[1:])
+	d.Stop()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if ret != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(ret)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "dht: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+type peersResult struct {
+	InfoHash string
+	Peers    []string
+}
+
+func getPeers(d *dht.DHT, cfg *dht.Config, args []string) (interface{}, error) {
+	ih, err := dht.ParseInfoHash(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return collectPeers(d, cfg, ih, false), nil
+}
+
+// collectPeers 反复查找ih的peer，直到找到cfg.NumTargetPeers个peer或者超时。
+func collectPeers(d *dht.DHT, cfg *dht.Config, ih dht.InfoHash, announce bool) peersResult {
+	deadline := time.After(*timeout)
+	research := time.NewTicker(researchPeriod)
+	defer research.Stop()
+	d.PeersRequest(string(ih), announce)
+	for len(d.PeersFor(ih)) < cfg.NumTargetPeers {
+		select {
+		case <-d.PeersRequestResults:
+		case <-research.C:
+			d.PeersRequest(string(ih), announce)
+		case <-deadline:
+			return peersResult{ih.Hex(), d.PeersFor(ih)}
+		}
+	}
+	return peersResult{ih.Hex(), d.PeersFor(ih)}
+}
+
+func ping(d *dht.DHT, cfg *dht.Config, args []string) (interface{}, error) {
+	addr, err := net.ResolveUDPAddr("udp", args[0])
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	d.AddNode(addr.String())
+	deadline := time.Now().Add(*timeout)
+	for time.Now().Before(deadline) {
+		for _, n := range d.Nodes() {
+			if n.Address == addr.String() && n.LastResponse.After(start) {
+				return n, nil
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("no reply from %v after %v", addr, *timeout)
+}
+
+func findNode(d *dht.DHT, cfg *dht.Config, args []string) (interface{}, error) {
+	id, err := dht.DecodeInfoHash(args[0])
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.After(*timeout)
+	research := time.NewTicker(researchPeriod)
+	defer research.Stop()
+	d.FindNode(string(id))
+	var last []dht.Node
+	for {
+		select {
+		case <-research.C:
+			// 最近的节点都回复过并且两次之间没有变化，说明查找已经收敛了。
+			closest := d.ClosestNodes(id, 8)
+			if converged(last, closest) {
+				return closest, nil
+			}
+			last = closest
+			d.FindNode(string(id))
+		case <-deadline:
+			return d.ClosestNodes(id, 8), nil
+		}
+	}
+}
+
+func converged(last, closest []dht.Node) bool {
+	if len(closest) == 0 || len(last) != len(closest) {
+		return false
+	}
+	for i := range closest {
+		if !closest[i].Reachable || closest[i].ID != last[i].ID {
+			return false
+		}
+	}
+	return true
+}
+
+type announceResult struct {
+	peersResult
+	Port      int
+	Announces int64 // 发出的announce_peer数
+}
+
+func announce(d *dht.DHT, cfg *dht.Config, args []string) (interface{}, error) {
+	ih, err := dht.ParseInfoHash(args[0])
+	if err != nil {
+		return nil, err
+	}
+	sent := func() int64 {
+		if v, ok := expvar.Get("totalSentAnnouncePeer").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := sent()
+	res := collectPeers(d, cfg, ih, true)
+	return announceResult{res, cfg.AnnouncePort, sent() - before}, nil
+}
+
+type sampleResult struct {
+	From     string
+	Num      int
+	Interval time.Duration
+	Samples  []string
+}
+
+func sample(d *dht.DHT, cfg *dht.Config, args []string) (interface{}, error) {
+	addr, err := net.ResolveUDPAddr("udp", args[0])
+	if err != nil {
+		return nil, err
+	}
+	d.SampleInfoHashes(addr.String())
+	select {
+	case r := <-d.SampleResults:
+		ret := sampleResult{From: r.From, Num: r.Num, Interval: r.Interval, Samples: make([]string, 0, len(r.Samples))}
+		for _, ih := range r.Samples {
+			ret.Samples = append(ret.Samples, ih.Hex())
+		}
+		return ret, nil
+	case <-time.After(*timeout):
+		return nil, fmt.Errorf("no sample_infohashes reply from %v after %v", addr, *timeout)
+	}
+}
+
+// jsonSink 把爬虫发现的infohash和peer逐行打印成JSON。
+type jsonSink struct {
+	enc *json.Encoder
+}
+
+type crawlRecord struct {
+	InfoHash string
+	From     string `json:",omitempty"`
+	Peer     string `json:",omitempty"`
+}
+
+func (s jsonSink) InfoHash(ih dht.InfoHash, from net.UDPAddr) {
+	s.enc.Encode(crawlRecord{InfoHash: ih.Hex(), From: from.String()})
+}
+
+func (s jsonSink) Peer(ih dht.InfoHash, peer net.UDPAddr) {
+	s.enc.Encode(crawlRecord{InfoHash: ih.Hex(), Peer: peer.String()})
+}
+
+func serve(d *dht.DHT, cfg *dht.Config, args []string) (interface{}, error) {
+	fmt.Fprintf(os.Stderr, "dht: serving on UDP port %d\n", d.Port())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+	return d.TableStats(), nil
+}
@@ -0,0 +1,549 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+/*
+	KRPC编解码。
+	以前用jackpal/bencode-go通过反射把每个包解码到responseType里，遇到奇怪的输入还会panic，只能靠recover()兜底，
+	在路由器上解码占了大部分CPU。这里的解码器直接在[]byte上工作，只解出responseType需要的key，
+	其余的值只检查格式然后跳过，不会分配内存。嵌套深度和包的大小都有上限，出错时返回带位置的DecodeError。
+	编码同样不用反射，queryMessage和replyMessage直接按bencode要求的key顺序拼接到[]byte上，空的"v"、"ip"和"n"不编码。
+ */
+
+// 解码错误，可以用errors.Is()和DecodeError.Err比较。
+var (
+	ErrPacketTooLarge = errors.New("krpc: packet too large")
+	ErrTooDeep        = errors.New("krpc: nesting too deep")
+	ErrSyntax         = errors.New("krpc: invalid bencode")
+	ErrType           = errors.New("krpc: unexpected value type")
+	ErrTrailingData   = errors.New("krpc: trailing data after message")
+)
+
+// KRPC消息最多是 dict -> dict -> list -> string，留出一些余量给扩展字段。
+const maxNestingDepth = 8
+
+// DecodeError 是解码失败的原因和出错的字节位置。
+type DecodeError struct {
+	Offset int
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+type decoder struct {
+	b     []byte
+	pos   int
+	depth int
+}
+
+func (d *decoder) fail(err error) error {
+	return &DecodeError{Offset: d.pos, Err: err}
+}
+
+func (d *decoder) peek() (byte, error) {
+	if d.pos >= len(d.b) {
+		return 0, d.fail(ErrSyntax)
+	}
+	return d.b[d.pos], nil
+}
+
+// readBytes 读取一个 <长度>:<内容> 的字符串，返回的切片指向原始数据，没有拷贝。
+func (d *decoder) readBytes() ([]byte, error) {
+	start := d.pos
+	n := 0
+	for {
+		if d.pos >= len(d.b) {
+			return nil, d.fail(ErrSyntax)
+		}
+		c := d.b[d.pos]
+		if c == ':' {
+			break
+		}
+		if c < '0' || c > '9' {
+			return nil, d.fail(ErrType)
+		}
+		if d.pos > start && d.b[start] == '0' {
+			return nil, d.fail(ErrSyntax)
+		}
+		n = n*10 + int(c-'0')
+		if n > len(d.b) {
+			return nil, d.fail(ErrSyntax)
+		}
+		d.pos++
+	}
+	if d.pos == start {
+		return nil, d.fail(ErrSyntax)
+	}
+	d.pos++
+	if n > len(d.b)-d.pos {
+		return nil, d.fail(ErrSyntax)
+	}
+	s := d.b[d.pos : d.pos+n]
+	d.pos += n
+	return s, nil
+}
+
+func (d *decoder) readString() (string, error) {
+	b, err := d.readBytes()
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readInt 读取一个 i<数字>e 的整数，拒绝前导零、"-0"和溢出。
+func (d *decoder) readInt() (int64, error) {
+	if c, err := d.peek(); err != nil {
+		return 0, err
+	} else if c != 'i' {
+		return 0, d.fail(ErrType)
+	}
+	d.pos++
+	neg := false
+	if d.pos < len(d.b) && d.b[d.pos] == '-' {
+		neg = true
+		d.pos++
+	}
+	start := d.pos
+	var n int64
+	for d.pos < len(d.b) && d.b[d.pos] != 'e' {
+		c := d.b[d.pos]
+		if c < '0' || c > '9' {
+			return 0, d.fail(ErrSyntax)
+		}
+		if n > (math.MaxInt64-9)/10 {
+			return 0, d.fail(ErrSyntax)
+		}
+		n = n*10 + int64(c-'0')
+		d.pos++
+	}
+	digits := d.pos - start
+	if d.pos >= len(d.b) || digits == 0 || (d.b[start] == '0' && (digits > 1 || neg)) {
+		return 0, d.fail(ErrSyntax)
+	}
+	d.pos++
+	if neg {
+		n = -n
+	}
+	return n, nil
+}
+
+// open 进入一个dict('d')或者list('l')。
+func (d *decoder) open(kind byte) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if c != kind {
+		return d.fail(ErrType)
+	}
+	d.depth++
+	if d.depth > maxNestingDepth {
+		return d.fail(ErrTooDeep)
+	}
+	d.pos++
+	return nil
+}
+
+// more 如果当前的dict或者list还有元素，返回true。遇到结尾的'e'时把它消费掉并返回false。
+func (d *decoder) more() (bool, error) {
+	c, err := d.peek()
+	if err != nil {
+		return false, err
+	}
+	if c == 'e' {
+		d.pos++
+		d.depth--
+		return false, nil
+	}
+	return true, nil
+}
+
+// skip 检查并跳过任意一个值。
+func (d *decoder) skip() error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == 'i':
+		_, err = d.readInt()
+		return err
+	case c >= '0' && c <= '9':
+		_, err = d.readBytes()
+		return err
+	case c == 'l' || c == 'd':
+		if err := d.open(c); err != nil {
+			return err
+		}
+		for {
+			more, err := d.more()
+			if err != nil {
+				return err
+			}
+			if !more {
+				return nil
+			}
+			if c == 'd' {
+				if _, err := d.readBytes(); err != nil {
+					return err
+				}
+			}
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+	}
+	return d.fail(ErrSyntax)
+}
+
+func (d *decoder) readStringList() ([]string, error) {
+	if err := d.open('l'); err != nil {
+		return nil, err
+	}
+	var ret []string
+	for {
+		more, err := d.more()
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return ret, nil
+		}
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+}
+
+// decodeReply 解码"r"字典。
+func (d *decoder) decodeReply(r *getPeersResponse) error {
+	if err := d.open('d'); err != nil {
+		return err
+	}
+	for {
+		more, err := d.more()
+		if err != nil || !more {
+			return err
+		}
+		key, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		switch string(key) {
+		case "id":
+			r.Id, err = d.readString()
+		case "nodes":
+			r.Nodes, err = d.readString()
+		case "nodes6":
+			r.Nodes6, err = d.readString()
+		case "token":
+			r.Token, err = d.readString()
+		case "values":
+			r.Values, err = d.readStringList()
+		case "samples":
+			r.Samples, err = d.readString()
+		case "num", "interval":
+			var n int64
+			if n, err = d.readInt(); err == nil && (n < 0 || n > math.MaxInt32) {
+				err = d.fail(ErrType)
+			}
+			if string(key) == "num" {
+				r.Num = int(n)
+			} else {
+				r.Interval = int(n)
+			}
+		default:
+			err = d.skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// decodeArgs 解码"a"字典。
+func (d *decoder) decodeArgs(a *answerType) error {
+	if err := d.open('d'); err != nil {
+		return err
+	}
+	for {
+		more, err := d.more()
+		if err != nil || !more {
+			return err
+		}
+		key, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		switch string(key) {
+		case "id":
+			a.Id, err = d.readString()
+		case "target":
+			a.Target, err = d.readString()
+		case "info_hash":
+			var ih string
+			ih, err = d.readString()
+			a.InfoHash = InfoHash(ih)
+		case "token":
+			a.Token, err = d.readString()
+		case "port":
+			var port int64
+			if port, err = d.readInt(); err == nil && (port < 0 || port > 65535) {
+				err = d.fail(ErrType)
+			}
+			a.Port = int(port)
+		case "implied_port":
+			var implied int64
+			implied, err = d.readInt()
+			a.ImpliedPort = int(implied)
+		default:
+			err = d.skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// decodeErrorList 解码"e"列表：[错误码, 错误信息]，多余的元素被忽略。
+func (d *decoder) decodeErrorList(e *KRPCError) error {
+	if err := d.open('l'); err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		more, err := d.more()
+		if err != nil || !more {
+			return err
+		}
+		switch i {
+		case 0:
+			var code int64
+			if code, err = d.readInt(); err == nil && (code < 0 || code > math.MaxInt32) {
+				err = d.fail(ErrType)
+			}
+			e.Code = int(code)
+		case 1:
+			e.Message, err = d.readString()
+		default:
+			err = d.skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// peekReply 不完整解码地查看b是不是回复("y"是"r"或"e")，并返回它的transaction ID，只用来在限速时判断优先级。
+// 只检查最外层的key，其余的值只跳过，不分配内存。返回的ID指向b，没有拷贝。
+func peekReply(b []byte) (transId []byte, ok bool) {
+	if len(b) > maxUDPPacketSize {
+		return nil, false
+	}
+	d := decoder{b: b}
+	if d.open('d') != nil {
+		return nil, false
+	}
+	var y []byte
+	for {
+		more, err := d.more()
+		if err != nil {
+			return nil, false
+		}
+		if !more {
+			break
+		}
+		key, err := d.readBytes()
+		if err != nil {
+			return nil, false
+		}
+		switch string(key) {
+		case "t":
+			transId, err = d.readBytes()
+		case "y":
+			y, err = d.readBytes()
+		default:
+			err = d.skip()
+		}
+		if err != nil {
+			return nil, false
+		}
+	}
+	return transId, len(y) == 1 && (y[0] == 'r' || y[0] == 'e')
+}
+
+// decodeMessage 把一个KRPC包解码到r中。
+func decodeMessage(b []byte, r *responseType) error {
+	if len(b) > maxUDPPacketSize {
+		return &DecodeError{Offset: maxUDPPacketSize, Err: ErrPacketTooLarge}
+	}
+	d := decoder{b: b}
+	if err := d.open('d'); err != nil {
+		return err
+	}
+	for {
+		more, err := d.more()
+		if err != nil {
+			return err
+		}
+		if !more {
+			break
+		}
+		key, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		switch string(key) {
+		case "t":
+			r.T, err = d.readString()
+		case "y":
+			r.Y, err = d.readString()
+		case "q":
+			r.Q, err = d.readString()
+		case "v":
+			r.V, err = d.readString()
+		case "ip":
+			r.IP, err = d.readString()
+		case "n":
+			r.N, err = d.readString()
+		case "r":
+			err = d.decodeReply(&r.R)
+		case "a":
+			err = d.decodeArgs(&r.A)
+		case "e":
+			err = d.decodeErrorList(&r.E)
+		default:
+			err = d.skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if d.pos != len(b) {
+		return d.fail(ErrTrailingData)
+	}
+	return nil
+}
+
+// krpcMessage 是可以被sendMsg发送的消息。
+type krpcMessage interface {
+	appendTo(b []byte) ([]byte, error)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = strconv.AppendInt(b, int64(len(s)), 10)
+	b = append(b, ':')
+	return append(b, s...)
+}
+
+func appendInt(b []byte, n int64) []byte {
+	b = append(b, 'i')
+	b = strconv.AppendInt(b, n, 10)
+	return append(b, 'e')
+}
+
+func appendValue(b []byte, v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case string:
+		return appendString(b, x), nil
+	case InfoHash:
+		return appendString(b, string(x)), nil
+	case []byte:
+		return appendString(b, string(x)), nil
+	case int:
+		return appendInt(b, int64(x)), nil
+	case int64:
+		return appendInt(b, x), nil
+	case []string:
+		b = append(b, 'l')
+		for _, s := range x {
+			b = appendString(b, s)
+		}
+		return append(b, 'e'), nil
+	case map[string]interface{}:
+		return appendDict(b, x)
+	}
+	return b, fmt.Errorf("krpc: cannot encode %T", v)
+}
+
+// appendDict 按照bencode的要求把key排序后编码。
+func appendDict(b []byte, m map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b = append(b, 'd')
+	var err error
+	for _, k := range keys {
+		b = appendString(b, k)
+		if b, err = appendValue(b, m[k]); err != nil {
+			return b, err
+		}
+	}
+	return append(b, 'e'), nil
+}
+
+func (m queryMessage) appendTo(b []byte) ([]byte, error) {
+	var err error
+	b = append(b, 'd')
+	b = appendString(b, "a")
+	if b, err = appendDict(b, m.A); err != nil {
+		return b, err
+	}
+	if m.N != "" {
+		b = appendString(b, "n")
+		b = appendString(b, m.N)
+	}
+	b = appendString(b, "q")
+	b = appendString(b, m.Q)
+	b = appendString(b, "t")
+	b = appendString(b, m.T)
+	if m.V != "" {
+		b = appendString(b, "v")
+		b = appendString(b, m.V)
+	}
+	b = appendString(b, "y")
+	b = appendString(b, m.Y)
+	return append(b, 'e'), nil
+}
+
+func (m replyMessage) appendTo(b []byte) ([]byte, error) {
+	var err error
+	b = append(b, 'd')
+	if m.IP != "" {
+		b = appendString(b, "ip")
+		b = appendString(b, m.IP)
+	}
+	if m.N != "" {
+		b = appendString(b, "n")
+		b = appendString(b, m.N)
+	}
+	b = appendString(b, "r")
+	if b, err = appendDict(b, m.R); err != nil {
+		return b, err
+	}
+	b = appendString(b, "t")
+	b = appendString(b, m.T)
+	if m.V != "" {
+		b = appendString(b, "v")
+		b = appendString(b, m.V)
+	}
+	b = appendString(b, "y")
+	b = appendString(b, m.Y)
+	return append(b, 'e'), nil
+}
@@ -0,0 +1,140 @@
+package dht
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var codecSeeds = []string{
+	"d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe",
+	"d1:ad2:id20:abcdefghij01234567899:info_hash20:mnopqrstuvwxyz1234564:porti6881e5:token8:aoeusnthe1:q13:announce_peer1:t2:aa1:y1:qe",
+	"d1:rd2:id20:abcdefghij01234567895:nodes26:abcdefghij0123456789xxxxxx5:token8:aoeusnth6:valuesl6:axje.u6:idhtnmee1:t2:aa1:y1:re",
+	"d1:eli201e5:errore1:t2:aa1:y1:ee",
+	// 被截断的整数和字符串
+	"d1:ad4:porti12",
+	"d1:ad4:porti-",
+	"d1:t5:ab",
+	"d1:t5",
+	"d2:id20:abc",
+	// 超过嵌套深度的列表和字典
+	"d1:x" + strings.Repeat("l", maxNestingDepth+2) + strings.Repeat("e", maxNestingDepth+2) + "e",
+	"d1:x" + strings.Repeat("d1:k", maxNestingDepth+2) + "i0e" + strings.Repeat("e", maxNestingDepth+2) + "e",
+	// 超长的长度
+	"d1:t99999999999999999999:ae",
+	"d1:t4294967296:ae",
+	"d1:ad4:porti99999999999999999999eee",
+}
+
+func FuzzReadResponse(f *testing.F) {
+	for _, s := range codecSeeds {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		_, err := readResponse(packetType{b: b})
+		if err == nil {
+			return
+		}
+		var de *DecodeError
+		if !errors.As(err, &de) {
+			t.Fatalf("error %v is not a *DecodeError", err)
+		}
+		if de.Offset < 0 || de.Offset > len(b) && !errors.Is(err, ErrPacketTooLarge) {
+			t.Fatalf("offset %d out of range for %d bytes", de.Offset, len(b))
+		}
+	})
+}
+
+func TestDecodeRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want error
+	}{
+		{"empty", "", ErrSyntax},
+		{"not a dict", "l1:ae", ErrType},
+		{"unterminated dict", "d", ErrSyntax},
+		{"truncated int", "d1:ad4:porti12", ErrSyntax},
+		{"int without digits", "d1:ad4:portieee", ErrSyntax},
+		{"negative zero", "d1:ad4:porti-0eee", ErrSyntax},
+		{"leading zero int", "d1:ad4:porti01eee", ErrSyntax},
+		{"int overflow", "d1:ad4:porti99999999999999999999eee", ErrSyntax},
+		{"truncated string", "d1:t5:abe", ErrSyntax},
+		{"truncated length", "d1:t5", ErrSyntax},
+		{"negative length", "d1:t-1:ae", ErrType},
+		{"leading zero length", "d1:t01:ae", ErrSyntax},
+		{"oversized length", "d1:t99999999999999999999:ae", ErrSyntax},
+		{"string where dict expected", "d1:a1:xe", ErrType},
+		{"int where string expected", "d1:ti1ee", ErrType},
+		{"port out of range", "d1:ad4:porti70000eee", ErrType},
+		{"lists too deep", "d1:x" + strings.Repeat("l", 20) + strings.Repeat("e", 20) + "e", ErrTooDeep},
+		{"dicts too deep", "d1:x" + strings.Repeat("d1:k", 20) + "i0e" + strings.Repeat("e", 20) + "e", ErrTooDeep},
+		{"trailing data", "d1:t2:aae1:x", ErrTrailingData},
+		{"too large", "d1:t" + strings.Repeat("x", maxUDPPacketSize) + "e", ErrPacketTooLarge},
+	}
+	for _, tt := range tests {
+		var r responseType
+		err := decodeMessage([]byte(tt.in), &r)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	q := queryMessage{T: "aa", Y: "q", Q: "announce_peer", A: map[string]interface{}{
+		"id":           "abcdefghij0123456789",
+		"info_hash":    InfoHash("mnopqrstuvwxyz123456"),
+		"port":         6881,
+		"implied_port": 1,
+		"token":        "tok",
+	}}
+	b, err := q.appendTo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r responseType
+	if err := decodeMessage(b, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.T != "aa" || r.Y != "q" || r.Q != "announce_peer" || r.A.Id != "abcdefghij0123456789" ||
+		r.A.InfoHash != "mnopqrstuvwxyz123456" || r.A.Port != 6881 || r.A.ImpliedPort != 1 || r.A.Token != "tok" {
+		t.Fatalf("%+v", r)
+	}
+
+	rep := replyMessage{T: "bb", Y: "r", R: map[string]interface{}{"id": "abcdefghij0123456789", "values": []string{"abcdef", "ghijkl"}}}
+	if b, err = rep.appendTo(nil); err != nil {
+		t.Fatal(err)
+	}
+	r = responseType{}
+	if err := decodeMessage(b, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Y != "r" || r.R.Id != "abcdefghij0123456789" || len(r.R.Values) != 2 || r.R.Values[1] != "ghijkl" {
+		t.Fatalf("%+v", r)
+	}
+}
+
+func TestPeekReply(t *testing.T) {
+	tests := []struct {
+		in    string
+		t     string
+		reply bool
+	}{
+		{codecSeeds[0], "aa", false},
+		{codecSeeds[2], "aa", true},
+		{codecSeeds[3], "aa", true},
+		{"d1:t2:bb1:y1:re", "bb", true},
+		{"d1:y1:e1:t2:cce", "cc", true},
+		{"d1:t2:aa1:y2:rre", "aa", false},
+		{"d1:rd1:t2:xx1:y1:re1:y1:ee", "", true},
+		{"d1:t2:aa1:y1:r", "", false},
+		{"l1:t2:aae", "", false},
+	}
+	for _, tt := range tests {
+		transId, reply := peekReply([]byte(tt.in))
+		if reply != tt.reply || reply && string(transId) != tt.t {
+			t.Errorf("%q: got %q, %v, want %q, %v", tt.in, transId, reply, tt.t, tt.reply)
+		}
+	}
+}
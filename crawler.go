@@ -0,0 +1,174 @@
+package dht
+
+import (
+	"expvar"
+	"net"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/nettools"
+)
+
+/*
+	爬虫模式(Config.CrawlerMode)，用来发现整个DHT网络中的infohash。
+	伪造ID：每次和一个节点通信时，我们都用一个和它的ID只有最后几个字节不同的ID(idFor)，
+	它会认为我们离它非常近，把我们放进最近的桶里，之后别人查找它附近的infohash时就会问到我们。
+	收到的get_peers和announce_peer中的infohash和peer交给DHT.Sink，announce_peer的peer不会保存到peerStore。
+	遍历：回复find_node和sample_infohashes的节点和回复里的节点放进一个队列，每crawlPeriod取出一批，
+	向每个节点发送一个随机target的sample_infohashes(BEP 51)，样本交给Sink，回复里的节点再放进队列。
+	不支持sample_infohashes的节点(回复错误)改为发送find_node。节点要求的interval过去之前不会再访问同一个节点。
+	速度：每秒最多访问RateLimit/crawlRateDivisor个节点，剩下的收包预算留给别人发给我们的query。
+	去重：infohash和(infohash, peer)各用一个LRU记住最近报告过的，同一个只报告一次。
+	访问过的节点在query结束后，如果路由表已经超过MaxNodes就被删除，路由表不会无限增长。
+	Sink在主goroutine中被调用，这时持有d.mu，所以不能阻塞太久。
+ */
+
+const (
+	crawlPeriod        = time.Second
+	crawlRateDivisor   = 2       // 每秒访问RateLimit的这么多分之一个节点
+	crawlUnlimitedRate = 1000    // RateLimit取消时每秒访问的节点数
+	maxCrawlQueue      = 1 << 16 // 等待访问的节点队列的最大长度，超过的丢掉
+	crawlSeenSize      = 1 << 18 // 去重用的LRU的大小
+	crawlVisitedSize   = 1 << 18 // 记住多少个访问过的节点
+	crawlRevisit       = 10 * time.Minute
+	fakeIdSuffixLen    = 5 // 伪造ID时保留的我们自己ID的最后这么多个字节
+)
+
+// CrawlSink 接收爬虫发现的infohash和peer，每个只报告一次。
+type CrawlSink interface {
+	// InfoHash 报告一个新的infohash，from是让我们知道它的节点。
+	InfoHash(ih InfoHash, from net.UDPAddr)
+	// Peer 报告一个通过announce_peer宣布自己的peer。
+	Peer(ih InfoHash, peer net.UDPAddr)
+}
+
+type crawlTarget struct {
+	id   string
+	addr string
+}
+
+type crawler struct {
+	rate       int
+	queue      []crawlTarget
+	visited    *lru.Cache // 地址 -> 下一次可以访问的时间
+	infoHashes *lru.Cache
+	peers      *lru.Cache
+}
+
+func newCrawler(rateLimit int64) *crawler {
+	rate := int(rateLimit / crawlRateDivisor)
+	if rateLimit <= 0 {
+		rate = crawlUnlimitedRate
+	} else if rate < 1 {
+		rate = 1
+	}
+	return &crawler{
+		rate:       rate,
+		visited:    lru.New(crawlVisitedSize),
+		infoHashes: lru.New(crawlSeenSize),
+		peers:      lru.New(crawlSeenSize),
+	}
+}
+
+// idFor 返回和remoteId通信时使用的ID。爬虫模式下是一个和remoteId相邻的ID，否则就是d.nodeId。
+func (d *DHT) idFor(remoteId string) string {
+	if d.crawler == nil || len(remoteId) != nodeIdLen {
+		return d.nodeId
+	}
+	return remoteId[:nodeIdLen-fakeIdSuffixLen] + d.nodeId[nodeIdLen-fakeIdSuffixLen:]
+}
+
+// enqueue 把一个节点放进访问队列，最近访问过的节点会被跳过。必须在持有d.mu的情况下调用。
+func (c *crawler) enqueue(id, addr string, now time.Time) {
+	if next, ok := c.visited.Get(addr); ok && now.Before(next.(time.Time)) {
+		return
+	}
+	if len(c.queue) >= maxCrawlQueue {
+		totalCrawlQueueDropped.Add(1)
+		return
+	}
+	// 在这里就记下来，免得同一个节点在队列里出现很多次。
+	c.visited.Add(addr, now.Add(crawlRevisit))
+	c.queue = append(c.queue, crawlTarget{id, addr})
+}
+
+// crawl 从队列中取出一批节点并访问它们，队列空的时候从随机的target开始find_node。必须在持有d.mu的情况下调用。
+func (d *DHT) crawl() {
+	c := d.crawler
+	if len(c.queue) == 0 {
+		d.exploreKeyspace()
+		return
+	}
+	n := c.rate * int(crawlPeriod/time.Second)
+	if n > len(c.queue) {
+		n = len(c.queue)
+	}
+	for _, t := range c.queue[:n] {
+		r, err := d.routingTable.getOrCreateNode(t.id, t.addr, d.config.UDPProto)
+		if err != nil {
+			continue
+		}
+		totalCrawledNodes.Add(1)
+		if q := d.sampleFrom(r, string(randNodeId())); q != nil {
+			q.crawl = true
+		}
+	}
+	c.queue = append(c.queue[:0], c.queue[n:]...)
+}
+
+// crawlNodes 把回复的节点from和它回复的紧凑节点字符串中的节点放进访问队列。必须在持有d.mu的情况下调用。
+func (d *DHT) crawlNodes(from *remoteNode, nodes string) {
+	now := time.Now()
+	d.crawler.enqueue(from.id, from.address.String(), now)
+	for id, address := range parseNodesString(nodes, d.config.UDPProto, d.blocklist) {
+		// 别人回复的节点里也有我们自己，用的是我们以前给它的伪造ID。
+		if d.isOwnId(id) || id[nodeIdLen-fakeIdSuffixLen:] == d.nodeId[nodeIdLen-fakeIdSuffixLen:] {
+			continue
+		}
+		d.crawler.enqueue(id, address, now)
+	}
+}
+
+// crawlFinished 在对一个被访问的节点的query结束时调用，路由表太大时删除这个节点。必须在持有d.mu的情况下调用。
+func (d *DHT) crawlFinished(node *remoteNode) {
+	if len(node.pendingQueries) > 0 || d.routingTable.length() <= d.maxNodes() {
+		return
+	}
+	if d.routingTable.addresses[node.address.String()] == node {
+		d.routingTable.kill(node, d.peerStore)
+	}
+}
+
+// foundInfoHash 把没有报告过的infohash交给Sink。
+func (d *DHT) foundInfoHash(ih InfoHash, from net.UDPAddr) {
+	if d.Sink == nil {
+		return
+	}
+	if _, ok := d.crawler.infoHashes.Get(ih); ok {
+		return
+	}
+	d.crawler.infoHashes.Add(ih, true)
+	totalCrawlInfoHashes.Add(1)
+	d.Sink.InfoHash(ih, from)
+}
+
+// foundPeer 把没有报告过的(infohash, peer)交给Sink。
+func (d *DHT) foundPeer(ih InfoHash, peer net.UDPAddr) {
+	if d.Sink == nil {
+		return
+	}
+	key := string(ih) + nettools.DottedPortToBinary(peer.String())
+	if _, ok := d.crawler.peers.Get(key); ok {
+		return
+	}
+	d.crawler.peers.Add(key, true)
+	totalCrawlPeers.Add(1)
+	d.Sink.Peer(ih, peer)
+}
+
+var (
+	totalCrawledNodes      = expvar.NewInt("totalCrawledNodes")
+	totalCrawlInfoHashes   = expvar.NewInt("totalCrawlInfoHashes")
+	totalCrawlPeers        = expvar.NewInt("totalCrawlPeers")
+	totalCrawlQueueDropped = expvar.NewInt("totalCrawlQueueDropped")
+)
@@ -0,0 +1,266 @@
+package dht
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+/*
+	调试和管理用的HTTP服务，Config.DebugAddr不为空时由Start()启动。
+	以前要看一个节点在做什么只能提高glog的级别再重启，现在可以直接读取它的状态：
+
+		GET  /debug/dht             节点ID、外部地址和汇总信息
+		GET  /debug/dht/nodes       路由表中的节点和它们的质量
+		GET  /debug/dht/table       每个前缀深度的节点数和二叉树的高度
+		GET  /debug/dht/infohashes  peerStore中的infohash、它们的peer数和占用的内存
+		GET  /debug/dht/lookups     正在进行的查找
+		GET  /debug/dht/bans        封禁列表
+		GET  /debug/dht/metrics     expvar指标
+		POST /debug/dht/addnode     addr=host:port，和AddNode()一样
+		POST /debug/dht/peers       ih=<40个十六进制字符>&announce=true，和PeersRequest()一样
+		POST /debug/dht/save        马上保存路由表
+
+	除了metrics，所有的回复都是JSON。GET接口没有认证，所以这个服务只应该监听本地地址。
+	POST接口会修改节点的状态，只有设置了Config.DebugToken时才提供，并且请求头X-Debug-Token必须等于它。
+	浏览器跨域时不能不经过预检就设置自定义的请求头，而我们不回复预检，所以本机浏览器中的网页不能用CSRF调用这些接口。
+ */
+
+// Stop()等待调试服务处理完正在进行的请求的最长时间。这些请求在等主goroutine时会因为d.stop马上返回。
+const debugShutdownTimeout = 5 * time.Second
+
+// debugSummary 是/debug/dht返回的内容。
+type debugSummary struct {
+	NodeID         string
+	Port           int
+	ExternalAddr   string
+	Nodes          int
+	Reachable      int
+	TreeDepth      int
+	InfoHashes     int
+	PeerStoreBytes int
+	PendingQueries int
+}
+
+type debugTable struct {
+	TableStats
+	TreeDepth int
+}
+
+type debugInfoHash struct {
+	InfoHash      string
+	Count         int
+	Alive         int
+	Bytes         int
+	LocalDownload bool
+}
+
+type debugLookup struct {
+	Type     string
+	Target   string
+	Pending  int
+	Duration time.Duration // 最早的一个还没回复的query发出了多久
+}
+
+func (d *DHT) startDebugServer(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/dht", d.serveSummary)
+	mux.HandleFunc("/debug/dht/nodes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.NodeQualities())
+	})
+	mux.HandleFunc("/debug/dht/table", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.RLock()
+		depth := d.routingTable.depth()
+		d.mu.RUnlock()
+		writeJSON(w, debugTable{d.TableStats(), depth})
+	})
+	mux.HandleFunc("/debug/dht/infohashes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.debugInfoHashes())
+	})
+	mux.HandleFunc("/debug/dht/lookups", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.debugLookups())
+	})
+	mux.HandleFunc("/debug/dht/bans", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.Bans())
+	})
+	mux.Handle("/debug/dht/metrics", expvar.Handler())
+	if d.config.DebugToken != "" {
+		mux.HandleFunc("/debug/dht/addnode", d.requireToken(d.serveAddNode))
+		mux.HandleFunc("/debug/dht/peers", d.requireToken(d.servePeersRequest))
+		mux.HandleFunc("/debug/dht/save", d.requireToken(d.serveSave))
+	}
+
+	d.debugServer = &http.Server{Handler: mux}
+	log.V(1).Infof("DHT: debug server listening on %v", l.Addr())
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		if err := d.debugServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Warningf("DHT: debug server: %v", err)
+		}
+	}()
+	return nil
+}
+
+// stopDebugServer 关闭调试服务，并等待正在处理的请求结束，这样Stop()返回之后就不会再有请求访问DHT。
+func (d *DHT) stopDebugServer() {
+	if d.debugServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), debugShutdownTimeout)
+	defer cancel()
+	if err := d.debugServer.Shutdown(ctx); err != nil {
+		log.Warningf("DHT: debug server shutdown: %v", err)
+		d.debugServer.Close()
+	}
+}
+
+// requireToken 只让X-Debug-Token请求头等于Config.DebugToken的POST请求调用h。
+func (d *DHT) requireToken(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		token := r.Header.Get("X-Debug-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(d.config.DebugToken)) != 1 {
+			http.Error(w, "invalid X-Debug-Token", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.V(3).Infof("DHT: debug server write: %v", err)
+	}
+}
+
+func (d *DHT) serveSummary(w http.ResponseWriter, r *http.Request) {
+	s := debugSummary{Port: d.config.Port}
+	if addr, ok := d.ExternalAddr(); ok {
+		s.ExternalAddr = addr.String()
+	}
+	d.mu.RLock()
+	s.NodeID = hex.EncodeToString([]byte(d.nodeId))
+	s.Nodes = d.routingTable.numNodes()
+	for _, n := range d.routingTable.addresses {
+		if n.reachable {
+			s.Reachable++
+		}
+	}
+	s.TreeDepth = d.routingTable.depth()
+	s.InfoHashes = len(d.peerStore.index)
+	s.PeerStoreBytes = d.peerStore.bytes
+	s.PendingQueries = len(d.transactions)
+	d.mu.RUnlock()
+	writeJSON(w, s)
+}
+
+func (d *DHT) debugInfoHashes() []debugInfoHash {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	ret := make([]debugInfoHash, 0, len(d.peerStore.index))
+	for ih, peers := range d.peerStore.index {
+		ret = append(ret, debugInfoHash{
+			InfoHash:      hex.EncodeToString([]byte(ih)),
+			Count:         peers.Size(),
+			Alive:         peers.Alive(),
+			Bytes:         peers.bytes(),
+			LocalDownload: d.peerStore.localActiveDownloads[ih],
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].InfoHash < ret[j].InfoHash })
+	return ret
+}
+
+// debugLookups 把还没有结束的query按照类型和目标分组。
+func (d *DHT) debugLookups() []debugLookup {
+	type key struct {
+		ty string
+		ih InfoHash
+	}
+	now := time.Now()
+	d.mu.RLock()
+	lookups := make(map[key]*debugLookup)
+	for _, q := range d.transactions {
+		k := key{q.Type, q.ih}
+		l, ok := lookups[k]
+		if !ok {
+			l = &debugLookup{Type: q.Type, Target: hex.EncodeToString([]byte(q.ih))}
+			lookups[k] = l
+		}
+		l.Pending++
+		if !q.sent.IsZero() && now.Sub(q.sent) > l.Duration {
+			l.Duration = now.Sub(q.sent)
+		}
+	}
+	d.mu.RUnlock()
+	ret := make([]debugLookup, 0, len(lookups))
+	for _, l := range lookups {
+		ret = append(ret, *l)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Type != ret[j].Type {
+			return ret[i].Type < ret[j].Type
+		}
+		return ret[i].Target < ret[j].Target
+	})
+	return ret
+}
+
+// 下面这些请求要交给主goroutine处理，requireToken已经检查过方法和token。DHT已经停止时返回503，不会一直卡住。
+
+func (d *DHT) serveAddNode(w http.ResponseWriter, r *http.Request) {
+	addr := r.FormValue("addr")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		http.Error(w, "invalid addr: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	select {
+	case d.remoteNodeAcquaintance <- addr:
+		writeJSON(w, "ok")
+	case <-d.stop:
+		http.Error(w, "DHT stopped", http.StatusServiceUnavailable)
+	}
+}
+
+func (d *DHT) servePeersRequest(w http.ResponseWriter, r *http.Request) {
+	ih, err := hex.DecodeString(r.FormValue("ih"))
+	if err != nil || len(ih) != nodeIdLen {
+		http.Error(w, "ih must be 40 hex characters", http.StatusBadRequest)
+		return
+	}
+	announce := r.FormValue("announce") == "true" || r.FormValue("announce") == "1"
+	select {
+	case d.peersRequest <- ihReq{ih: InfoHash(ih), download: announce}:
+		writeJSON(w, "ok")
+	case <-d.stop:
+		http.Error(w, "DHT stopped", http.StatusServiceUnavailable)
+	}
+}
+
+func (d *DHT) serveSave(w http.ResponseWriter, r *http.Request) {
+	select {
+	case d.saveRequest <- true:
+		writeJSON(w, "ok")
+	case <-d.stop:
+		http.Error(w, "DHT stopped", http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,36 @@
+package dht
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugRequireToken(t *testing.T) {
+	d := &DHT{config: Config{DebugToken: "secret"}}
+	h := d.requireToken(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		want   int
+	}{
+		{"valid", http.MethodPost, "secret", http.StatusNoContent},
+		{"GET", http.MethodGet, "secret", http.StatusMethodNotAllowed},
+		{"no token", http.MethodPost, "", http.StatusForbidden},
+		{"wrong token", http.MethodPost, "secre", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/debug/dht/save", nil)
+		if tt.token != "" {
+			r.Header.Set("X-Debug-Token", tt.token)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
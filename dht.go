@@ -10,6 +10,10 @@ import (
 	"crypto/rand"
 	"strings"
 	"expvar"
+	"crypto/sha1"
+	"io"
+	"fmt"
+	"net/http"
 )
 
 /* 消息类型：
@@ -31,19 +35,39 @@ import (
 type Config struct {
 	Address string 					// 监听的IP address，如果留下空白，会自动选择一个。
 	Port int 						// DHT节点会监听的UDP端口，如果是0，将会挑选一个随机端口。
-	NumTargetPeers int 				// DHT将尝试为每个被搜索的infohash寻找的对等点。这可能会被转移到per-infohash选项。默认值:5。
+	NumTargetPeers int 				// DHT将尝试为每个被搜索的infohash寻找的对等点。SearchOptions.TargetPeers可以为单个infohash设置。默认值:5。
 	DHTRouters string 				// 用于引导网络的DHT路由器的分离列表。
 	MaxNodes int 					// 在路由表中存储的最大节点数。默认值:100。
 	CleanupPeriod time.Duration 	// 在网络中ping节点的频率，以确定它们是否可到达。默认值：15分钟。
 	SaveRoutingTable bool 			// 如果True，节点将在启动时从磁盘读取路由表，并每隔几分钟保存磁盘上的路由表快照。默认值:True。
 	SavePeriod time.Duration 		// 将路由表保存到磁盘的频率。默认值：5分钟。
 	RateLimit int64 				// 每秒处理的最大数据包数量。如果是负数就取消。默认值:100。
-	MaxInfoHashes int 				// MaxInfoHashes是我们应该保留一个对等列表的信息的数量的限制。
-	// 如果这个和MaxInfoHashPeers没有改变，它应该消耗大约25 MB的RAM。更大的值有助于保持DHT网络的健康。默认值:2048。
-	MaxInfoHashPeers int 			// MaxInfoHashPeers是每个infohash跟踪的对等点的数量限制。一个单独的对等接触通常会消耗6个字节。默认值:256。
+	SendRateLimit int64 			// 每秒发送的最大数据包数量。如果是负数就取消。默认值:200。
+	QueryTimeout time.Duration 		// 等待query回复的最长时间，RTT已知的节点会用更短的时间。默认值:5秒。
+	MaxInfoHashes int 				// MaxInfoHashes是我们应该保留一个对等列表的信息的数量的限制。0表示只由PeerStoreBytes限制。默认值:0。
+	MaxInfoHashPeers int 			// MaxInfoHashPeers是每个infohash跟踪的对等点的数量限制。一个IPv4的peer连同元数据占19个字节，IPv6占31个字节。默认值:256。
+	PeerStoreBytes int 				// peerStore的内存预算，超过时删除最久没有用过的infohash。每个infohash大约有256字节的固定开销，
+	// 所以32 MB大约能保存10万个有几个peer的infohash。0表示不限制。默认值:32 MB。
 	ClientPerMinuteLimit int 		//  ClientPerMinuteLimit 通过对抗垃圾客户端来进行保护。如果超过每分钟的数据包数量，请忽略它们的请求。默认值:50。
 	ThrottlerTrackedClients int64 	// ThrottlerTrackedClients是客户端节流器所记得的主机的数量。LRU是用来跟踪最有趣的。默认值:1000。
+	SubnetPerMinuteLimit int 		// 同一个/24(IPv6是/64)网段每分钟最多处理的包数。如果是0或负数就取消。默认值:500。
+	AbuseBanThreshold int 			// 一个主机在10分钟内发送这么多次无法解码的包或者错误的token就会被封禁。如果是0或负数就取消。默认值:5。
+	AbuseBanDuration time.Duration 	// 封禁的时长。默认值:1小时。
 	UDPProto string 				// UDP连接的协议，udp4 = IPv4  udp6 = IPv6
+	Workers int 					// 并行收包和解码的goroutine数量。1表示所有的包都在主goroutine中处理。默认值:1。
+	BlockOnFullArena bool 			// 接收缓冲区用完时，如果True就等待缓冲区被释放，否则丢掉新的包。缓冲区的数量根据RateLimit计算。默认值:false。
+	StateDir string 				// 保存路由表的目录。如果留下空白，使用$HOME/.cantontorrent。
+	StoreBackend string 			// 持久化后端：file、memory或bolt。默认值:file。
+	Store Store 					// 如果不为nil，直接使用这个后端，忽略StateDir和StoreBackend。它属于调用者，Stop()不会关闭它。
+	Blocklist string 				// 逗号分隔的IP黑名单文件(PeerGuardian P2P格式或者CIDR列表)。文件被修改后会自动重新加载。
+	CrawlerMode bool 				// 作为爬虫运行：使用和对方相邻的伪造ID，遍历整个网络并用sample_infohashes收集infohash，发现的infohash和peer交给DHT.Sink。默认值:false。
+	RouterMode bool 				// 作为引导路由器运行：不保存peer，路由表大小是MaxNodes的20倍，更频繁地检查节点，回复分散在ID空间中的节点。默认值:false。
+	AnnouncePort int 				// announce_peer中宣布的端口，也就是torrent客户端接受连接的端口。0表示使用Port。
+	DebugAddr string 				// 调试和管理用的HTTP服务监听的地址，例如"localhost:8711"。为空时不启动。
+	DebugToken string 				// 调试服务中会修改状态的POST接口需要的token，放在X-Debug-Token请求头中。为空时不提供这些接口。
+	NetworkID string 				// 私有网络的ID，只和NetworkID相同的节点通信。为空时加入公共的Mainline DHT。设置了它而DHTRouters是默认值时，DHTRouters会被清空。
+	PSK string 						// 预共享密钥。不为空时每个包都用从它算出来的密钥加密和认证，并且拒绝重放的包，只有PSK相同的节点可以通信。为空时不加密。
+	ClientVersion string 			// 每个消息的"v"字段，按照BEP 20是两个字母的客户端代码加上两个字节的版本。为空时不发送。默认值:"JX01"。
 }
 
 // 把Config填充上默认值
@@ -51,17 +75,27 @@ func NewConfig() *Config {
 	return &Config{
 		Address:"",
 		Port:0,
-		NumTargetPeers:"router.magnets.im:6881,router.bittorrent.com:6881,dht.transmissionbt.com:6881",
+		NumTargetPeers:5,
+		DHTRouters:defaultDHTRouters,
 		MaxNodes:500,
 		CleanupPeriod:15*time.Minute,
 		SaveRoutingTable:true,
 		SavePeriod:5*time.Minute,
 		RateLimit:100,
-		MaxInfoHashes:2048,
+		SendRateLimit:200,
+		QueryTimeout:5*time.Second,
+		MaxInfoHashes:0,
 		MaxInfoHashPeers:256,
+		PeerStoreBytes:32 << 20,
 		ClientPerMinuteLimit:50,
+		Workers:1,
 		ThrottlerTrackedClients:1000,
+		SubnetPerMinuteLimit:500,
+		AbuseBanThreshold:5,
+		AbuseBanDuration:time.Hour,
 		UDPProto:"udp4",
+		StoreBackend:StoreFile,
+		ClientVersion:"JX01",
 	}
 }
 
@@ -72,21 +106,56 @@ func RegisterFlags(c *Config) {
 	if c == nil {
 		c = DefaultConfig
 	}
+	flag.StringVar(&c.Address, "address", c.Address,
+		"IP address to listen on. Empty listens on all addresses.")
+	flag.IntVar(&c.Port, "port", c.Port,
+		"UDP port to listen on. 0 picks a random port.")
 	flag.StringVar(&c.DHTRouters, "routers", c.DHTRouters,
 		"Comma separated addresses of DHT routers used to bootstrap the DHT network.")
 	flag.IntVar(&c.MaxNodes, "maxNodes", c.MaxNodes,
 		"Maximum number of nodes to store in the routing table, in memory. This is the primary configuration for how noisy or aggressive this node should be. When the node starts, it will try to reach d.config.MaxNodes/2 as quick as possible, to form a healthy routing table.")
+	flag.IntVar(&c.PeerStoreBytes, "peerStoreBytes", c.PeerStoreBytes,
+		"Memory budget in bytes for stored peers. The least recently used infohashes are dropped beyond it. 0 means no limit.")
 	flag.DurationVar(&c.CleanupPeriod, "cleanupPeriod", c.CleanupPeriod,
 		"How often to ping nodes in the network to see if they are reachable.")
 	flag.DurationVar(&c.SavePeriod, "savePeriod", c.SavePeriod,
 		"How often to save the routing table to disk.")
+	flag.StringVar(&c.StateDir, "stateDir", c.StateDir,
+		"Directory where the routing table is saved. Defaults to $HOME/.cantontorrent.")
+	flag.StringVar(&c.StoreBackend, "store", c.StoreBackend,
+		"Persistence backend for the routing table: file, memory or bolt.")
+	flag.IntVar(&c.Workers, "workers", c.Workers,
+		"Number of goroutines reading and decoding packets in parallel. 1 processes everything in the main loop.")
+	flag.StringVar(&c.Blocklist, "blocklist", c.Blocklist,
+		"Comma separated list of IP blocklist files, in PeerGuardian P2P or CIDR format. Nodes and peers in these ranges are ignored.")
 	flag.Int64Var(&c.RateLimit, "rateLimit", c.RateLimit,
 		"Maximum packets per second to be processed. Beyond this limit they are silently dropped. Set to -1 to disable rate limiting.")
+	flag.DurationVar(&c.QueryTimeout, "queryTimeout", c.QueryTimeout,
+		"Maximum time to wait for a reply to a query. Nodes with a known RTT get a shorter deadline.")
+	flag.BoolVar(&c.RouterMode, "router", c.RouterMode,
+		"Run as a bootstrap router: store no peers, keep a much larger routing table and reply with nodes spread across the keyspace.")
+	flag.IntVar(&c.AnnouncePort, "announcePort", c.AnnouncePort,
+		"Port announced to other nodes in announce_peer, i.e. where the torrent client accepts connections. 0 uses the DHT port.")
+	flag.StringVar(&c.DebugAddr, "debugAddr", c.DebugAddr,
+		"Address for the HTTP debug and admin server, e.g. localhost:8711. Empty disables it. Do not expose it publicly.")
+	flag.StringVar(&c.DebugToken, "debugToken", c.DebugToken,
+		"Token required in the X-Debug-Token header by the debug server's POST endpoints. Empty disables those endpoints.")
+	flag.BoolVar(&c.CrawlerMode, "crawler", c.CrawlerMode,
+		"Run as a crawler: use fake node IDs next to remote nodes, walk the whole network and sample its infohashes.")
+	flag.StringVar(&c.NetworkID, "networkID", c.NetworkID,
+		"ID of a private DHT network. Only nodes with the same ID are talked to. Empty joins the public Mainline DHT.")
+	flag.StringVar(&c.PSK, "psk", c.PSK,
+		"Pre-shared key. If set, every packet is encrypted and authenticated with it and replays are rejected. Only nodes with the same key can talk.")
+	flag.StringVar(&c.ClientVersion, "clientVersion", c.ClientVersion,
+		"Client version sent in the \"v\" field of every message. Empty to omit it.")
+	flag.Int64Var(&c.SendRateLimit, "sendRateLimit", c.SendRateLimit,
+		"Maximum packets per second to be sent. Beyond this limit they are silently dropped. Set to -1 to disable rate limiting.")
 }
 
 const (
 	minNodes = 16  // 尽量确保至少这些节点位于路由表中。
 	secretRotatePeriod = 5 * time.Minute
+	resultsBuffer = 16 	// PeersRequestResults和SampleResults的缓冲区大小
 )
 
 type Logger interface {
@@ -100,26 +169,54 @@ type DHT struct {
 	config 	Config
 	routingTable *routingTable
 	peerStore	*peerStore
-	conn	*net.UDPConn
+	conn	packetConn
 	Logger	Logger
+	Sink	CrawlSink 	// 爬虫模式下接收发现的infohash和peer，必须在Start()之前设置
 	exploredNeighborhood	bool
 	remoteNodeAcquaintance	chan string
 	peersRequest	chan ihReq
 	nodesRequest	chan ihReq
+	sampleRequest	chan string
 	pingRequest	chan *remoteNode
+	saveRequest	chan bool
 	portRequest	chan int
 	stop	chan bool
 	wg	sync.WaitGroup
+	mu	*sync.RWMutex 	// 保护routingTable、peerStore和tokenSecrets，NodeGroup的成员共用一个
+	throttleMu	*sync.Mutex 	// 保护clientThrottle
+	timeouts	timeoutQueue 	// 等待回复的query，按截止时间排序
+	transactions	map[string]*queryType 	// 所有还没有结束的query，key是transaction ID
+	searches	map[InfoHash]*search 	// Search()和PeersRequest()开始的查找
+	subscriptions	map[InfoHash][]*PeerSubscription 	// SubscribePeers()的订阅
 	clientThrottle	*nettools.ClientThrottle
-	store	*dhtStore
+	abuse	*abuseTracker
+	blocklist	*blocklist
+	store	*State
+	storage	Store
 	tokenSecrets	[]string
-	// Public channels:
+	bytesArena	arena 	// 接收数据包用的缓冲区
+	recvBucket	*tokenBucket 	// 收包的令牌桶，nil表示不限速
+	sendBucket	*tokenBucket 	// 发包的令牌桶，nil表示不限速
+	externalAddr	*externalAddrVoter 	// 其他节点报告的我们的地址
+	networkTag	string 	// 每个消息的"n"字段，公共网络为空
+	probes	map[string]*remoteNode 	// 私有网络中还没有回复过的引导节点和种子，key是地址，见network.go
+	debugServer	*http.Server 	// Config.DebugAddr不为空时的调试服务
+	crawler	*crawler 	// 爬虫模式的状态，其他模式下是nil
+	group	*NodeGroup 	// 不为nil时这个节点是NodeGroup的成员，socket由group管理
+	inbox	chan krpcPacket 	// group解码之后分给这个成员的消息
+	stats	*expvar.Map 	// NodeGroup成员自己的计数，其他时候是nil
+	// Public channels. 主goroutine持有d.mu时不能等待应用程序，所以channel满了时结果会被丢掉并计入totalDroppedResults，
+	// 找到的peer仍然保存在peerStore中，可以用PeersFor()读取。
 	PeersRequestResults chan map[InfoHash][]string  // key = infohash , value = slice of peers
+	SampleResults chan SampleResult 	// SampleInfoHashes()的结果
 }
 
 type ihReq struct {
 	ih	InfoHash
-	announce bool
+	opts	SearchOptions
+	download	bool 	// 把ih记为本地下载，和cancel一起时取消本地下载
+	cancel	bool 	// CancelSearch()和RemoveDownload()
+	background	bool 	// AddDownload()的后台查找，结果只发给订阅者
 }
 
 // New()创建一个DHT node，如果config是nil，就用DefaultConfig填充，一旦创建DHT node之后，配置config就不能再更改
@@ -128,36 +225,84 @@ func New(config *Config) (node *DHT,err error) {
 		config = DefaultConfig
 	}
 	cfg := *config
+	if cfg.NetworkID != "" && cfg.DHTRouters == defaultDHTRouters {
+		// 私有网络不能用公共的引导路由器
+		cfg.DHTRouters = ""
+	}
 	node = &DHT{
 		config:cfg,
 		routingTable:newRoutingTable(),
-		peerStore:newPeerStore(cfg.MaxInfoHashes,cfg.MaxInfoHashPeers),
-		PeersRequestResults:make(chan map[InfoHash][]string, 1),
+		peerStore:newPeerStore(cfg.MaxInfoHashes,cfg.MaxInfoHashPeers,cfg.PeerStoreBytes),
+		PeersRequestResults:make(chan map[InfoHash][]string, resultsBuffer),
+		SampleResults:make(chan SampleResult, resultsBuffer),
 		stop:make(chan bool),
+		mu:new(sync.RWMutex),
+		throttleMu:new(sync.Mutex),
 		exploredNeighborhood:false,
 		// Buffer to avoid blocking on seeds
 		remoteNodeAcquaintance:make(chan string,100),
 		// Buffer to avoid deadlocks and blocking on sends
 		peersRequest:make(chan ihReq,100),
 		nodesRequest:make(chan ihReq,100),
+		sampleRequest:make(chan string,100),
 		portRequest:    make(chan int),
 		clientThrottle:nettools.NewThrottler(cfg.ClientPerMinuteLimit,cfg.ThrottlerTrackedClients),
+		abuse:newAbuseTracker(cfg.SubnetPerMinuteLimit,cfg.AbuseBanThreshold,cfg.AbuseBanDuration,cfg.ThrottlerTrackedClients),
 		tokenSecrets:[]string{newTokenSecret(),newTokenSecret()},
+		pingRequest:make(chan *remoteNode),
+		saveRequest:make(chan bool),
+		transactions:make(map[string]*queryType),
+		searches:make(map[InfoHash]*search),
+		subscriptions:make(map[InfoHash][]*PeerSubscription),
+		externalAddr:newExternalAddrVoter(),
+		networkTag:networkTag(cfg.NetworkID),
+		probes:make(map[string]*remoteNode),
+		bytesArena:newArena(maxUDPPacketSize,arenaSize(cfg.RateLimit)),
+		recvBucket:newTokenBucket(cfg.RateLimit),
+		sendBucket:newTokenBucket(cfg.SendRateLimit),
+	}
+	if cfg.CrawlerMode {
+		node.crawler = newCrawler(cfg.RateLimit)
+	}
+	if cfg.Blocklist != "" {
+		if node.blocklist,err = newBlocklist(cfg.Blocklist);err != nil {
+			return nil,err
+		}
+		node.routingTable.blocklist = node.blocklist
+		node.peerStore.blocklist = node.blocklist
 	}
-	c := openStore(cfg.Port,cfg.SaveRoutingTable)
+	storage,c,err := openStore(&cfg)
+	if err != nil {
+		return nil,err
+	}
+	node.storage = storage
 	node.store = c
+	if string(c.Network) != node.networkTag {
+		log.Warningf("DHT: saved routing table belongs to another network, ignoring %d saved nodes", len(c.Remotes))
+		c.Remotes = nil
+		c.Network = []byte(node.networkTag)
+	}
 	if len(c.Id) != 20 {
 		c.Id = randNodeId()
 		log.V(4).Infof("Using a new random node ID: %x %d", c.Id, len(c.Id))
-		saveStore(*c)
+		saveStore(storage,*c)
 	}
 	node.nodeId = string(c.Id)
 	node.routingTable.nodeId = node.nodeId
+	// 先把地址拷贝出来：主goroutine保存路由表时会替换c.Remotes，例如调试服务的/save。
+	remotes := make([]string, 0, len(c.Remotes))
+	for addr := range c.Remotes {
+		remotes = append(remotes, addr)
+	}
 	node.wg.Add(1)
 	go func(){
 		defer node.wg.Done()
-		for addr,_ := range c.Remotes{
-			node.AddNode(addr)
+		for _, addr := range remotes {
+			select {
+			case node.remoteNodeAcquaintance <- addr:
+			case <-node.stop:
+				return
+			}
 		}
 	}()
 	return
@@ -187,13 +332,52 @@ func newTokenSecret() string {
 // PeersRequest要求DHT为infoHash提供更多的对等点。如果连接的对等点正在积极地下载这个infohash，那么声明应该是正确的，
 // 通常情况下是这这样的，除非这个DHT节点只是一个不下载torrents的路由器。
 func (d *DHT) PeersRequest(ih string,announce bool){
-	d.peersRequest <- ihReq{InfoHash(ih),announce}
+	d.peersRequest <- ihReq{ih: InfoHash(ih), download: announce}
 	log.V(2).Infof("DHT: torrent client asking more peers for %x.", ih)
 }
 
+// FindNode 让DHT查找离id最近的节点，找到的节点会加入路由表，可以通过ClosestNodes()读取。
+func (d *DHT) FindNode(id string) {
+	d.nodesRequest <- ihReq{ih: InfoHash(id)}
+}
+
+// Start 打开UDP socket并在后台运行DHT节点，直到Stop()被调用。
+func (d *DHT) Start() error {
+	if d.group == nil {
+		if err := d.initSocket();err != nil {
+			return err
+		}
+	}
+	if d.config.DebugAddr != "" {
+		if err := d.startDebugServer(d.config.DebugAddr);err != nil {
+			if d.group == nil {
+				d.conn.Close()
+			}
+			return err
+		}
+	}
+	d.wg.Add(1)
+	go func(){
+		defer d.wg.Done()
+		d.loop()
+	}()
+	return nil
+}
+
 func (d *DHT) Stop(){
 	close(d.stop)
+	if d.conn != nil && d.group == nil {
+		// 关闭socket，让readFromSocket从ReadFromUDP中返回
+		d.conn.Close()
+	}
+	d.stopDebugServer()
 	d.wg.Wait()
+	d.closeStore()
+}
+
+// Save 让DHT马上把路由表保存到Store中，即使可达的节点很少。
+func (d *DHT) Save() {
+	d.saveRequest <- true
 }
 
 // Port() 返回给DHT的端口号，这在初始化带有端口0的DHT时非常有用，即自动端口分配，以便检索所使用的实际端口号。
@@ -213,32 +397,700 @@ func (d *DHT) getPeers(infoHash InfoHash){
 			}
 		}
 	}
-
+	for _,r := range closest {
+		d.getPeersFrom(r,infoHash)
+	}
 }
 
-func (d *DHT) getPeersFrom(r *remoteNode, ih InfoHash) {
+func (d *DHT) getPeersFrom(r *remoteNode, ih InfoHash) *queryType {
 	if r==nil{
-		return
+		return nil
 	}
 	totalSentGetPeers.Add(1)
 	ty := "get_peers"
-	transId := r.newQuery(ty)
-	if _,ok := r.pendingQueries[transId];ok{
-		r.pendingQueries[transId].ih = ih
-	}else{
-		r.pendingQueries[transId] = &queryType{ih:ih}
-	}
+	transId := d.newQuery(r,ty)
+	r.pendingQueries[transId].ih = ih
 	queryArguments := map[string]interface{}{
-		"id":        d.nodeId,
+		"id":        d.idFor(r.id),
 		"info_hash": ih,
 	}
-	query := queryMessage{transId, "q", ty, queryArguments}
+	query := queryMessage{T: transId, Y: "q", Q: ty, A: queryArguments}
 	if log.V(3) {
 		x := hashDistance(InfoHash(r.id), ih)
 		log.V(3).Infof("DHT sending get_peers. nodeID: %x@%v, InfoHash: %x , distance: %x", r.id, r.address, ih, x)
 	}
 	r.lastSearchTime = time.Now()
-	sendMsg(d.conn, r.address, query)
+	return d.sendQuery(r, query)
+}
+
+// send 把消息发给raddr，所有的消息都带上我们的客户端版本和网络标签，回复还带上对方的地址(BEP 42)。
+// 超过SendRateLimit的消息直接丢掉。返回消息是否真的写到了socket上。
+func (d *DHT) send(raddr net.UDPAddr, msg krpcMessage) bool {
+	if !d.sendBucket.allow(false) {
+		dropPacket(dropSendRateLimit)
+		return false
+	}
+	switch m := msg.(type) {
+	case queryMessage:
+		m.V, m.N = d.config.ClientVersion, d.networkTag
+		msg = m
+	case replyMessage:
+		m.V, m.N = d.config.ClientVersion, d.networkTag
+		m.IP = compactAddr(raddr)
+		msg = m
+	case errorMessage:
+		m.V, m.N = d.config.ClientVersion, d.networkTag
+		msg = m
+	}
+	return sendMsg(d.conn, raddr, msg)
+}
+
+func (d *DHT) initSocket() (err error) {
+	d.conn, err = openConn(&d.config)
+	return err
+}
+
+// openConn 按照cfg打开socket，设置了PSK时加上加密层。如果配置的是端口0，把系统分配的端口写回cfg.Port。
+func openConn(cfg *Config) (packetConn, error) {
+	conn, err := listen(cfg.Address, cfg.Port, cfg.UDPProto)
+	if err != nil {
+		return nil, err
+	}
+	var pc packetConn = conn
+	if cfg.PSK != "" {
+		if pc, err = newPSKConn(conn, cfg.PSK); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		cfg.Port = addr.Port
+	}
+	return pc, nil
+}
+
+func (d *DHT) bootstrap() {
+	for _, s := range strings.Split(d.config.DHTRouters, ",") {
+		if s == "" {
+			continue
+		}
+		r, err := d.contactNode(s)
+		if err != nil {
+			log.V(3).Infof("DHT: bootstrap router %v: %v", s, err)
+			continue
+		}
+		d.findNodeFrom(r, d.nodeId)
+	}
+}
+
+// loop 是DHT节点的主goroutine。routingTable和peerStore都不是线程安全的，主goroutine修改它们时持有d.mu，
+// 收包的goroutine只在读的时候加读锁。
+func (d *DHT) loop() {
+	var socketChan chan packetType
+	var msgChan chan krpcPacket
+	if d.group != nil {
+		// 收包和解码由group负责。
+		msgChan = d.inbox
+	} else if d.config.Workers > 1 {
+		msgChan = d.startWorkers(d.config.Workers)
+	} else {
+		socketChan = make(chan packetType)
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			readFromSocket(d.conn, socketChan, d.bytesArena, d.config.BlockOnFullArena, d.stop)
+		}()
+	}
+
+	d.mu.Lock()
+	d.bootstrap()
+	d.mu.Unlock()
+
+	cleanupTicker := time.NewTicker(d.cleanupPeriod())
+	defer cleanupTicker.Stop()
+	secretRotateTicker := time.NewTicker(secretRotatePeriod)
+	defer secretRotateTicker.Stop()
+	timeoutTicker := time.NewTicker(timeoutCheckPeriod)
+	defer timeoutTicker.Stop()
+	searchTicker := time.NewTicker(searchCheckPeriod)
+	defer searchTicker.Stop()
+	var blocklistTicker <-chan time.Time
+	if d.blocklist != nil {
+		t := time.NewTicker(blocklistCheckPeriod)
+		defer t.Stop()
+		blocklistTicker = t.C
+	}
+	var saveTicker <-chan time.Time
+	if d.config.SaveRoutingTable {
+		t := time.NewTicker(d.config.SavePeriod)
+		defer t.Stop()
+		saveTicker = t.C
+	}
+	var crawlTicker <-chan time.Time
+	if d.crawler != nil {
+		t := time.NewTicker(crawlPeriod)
+		defer t.Stop()
+		crawlTicker = t.C
+	}
+	if d.recvBucket == nil {
+		log.Warning("DHT: rate limiting disabled")
+	}
+
+	for {
+		select {
+		case <-d.stop:
+			log.V(1).Infof("DHT exiting.")
+			return
+		case addr := <-d.remoteNodeAcquaintance:
+			d.mu.Lock()
+			d.helloFromPeer(addr)
+			d.mu.Unlock()
+		case req := <-d.peersRequest:
+			d.mu.Lock()
+			d.startSearch(req)
+			d.mu.Unlock()
+		case req := <-d.nodesRequest:
+			d.mu.Lock()
+			d.findNode(string(req.ih))
+			d.mu.Unlock()
+		case addr := <-d.sampleRequest:
+			d.mu.Lock()
+			d.requestSample(addr)
+			d.mu.Unlock()
+		case p := <-socketChan:
+			totalRecv.Add(1)
+			r, ok := d.decodePacket(p)
+			// decodePacket已经把需要的数据拷贝出来了，可以马上还回block。
+			d.bytesArena.Push(p.b)
+			if ok {
+				d.mu.Lock()
+				d.handleMessage(p.raddr, r, false)
+				d.mu.Unlock()
+			}
+		case m := <-msgChan:
+			d.mu.Lock()
+			d.handleMessage(m.raddr, m.r, m.replied)
+			d.mu.Unlock()
+		case <-cleanupTicker.C:
+			d.mu.Lock()
+			needPing := d.routingTable.cleanup(d.cleanupPeriod(), d.peerStore)
+			if n := d.peerStore.expire(time.Now()); n > 0 {
+				totalExpiredPeers.Add(int64(n))
+			}
+			if d.needMoreNodes() {
+				d.bootstrap()
+				if d.config.RouterMode {
+					d.exploreKeyspace()
+				}
+			}
+			d.mu.Unlock()
+			d.wg.Add(1)
+			go func() {
+				defer d.wg.Done()
+				pingSlowly(d.pingRequest, needPing, d.cleanupPeriod(), d.stop)
+			}()
+		case node := <-d.pingRequest:
+			d.mu.Lock()
+			d.pingNode(node)
+			d.mu.Unlock()
+		case now := <-timeoutTicker.C:
+			d.mu.Lock()
+			d.expireQueries(now)
+			d.mu.Unlock()
+		case now := <-searchTicker.C:
+			d.mu.Lock()
+			d.checkSearches(now)
+			d.mu.Unlock()
+		case <-secretRotateTicker.C:
+			d.mu.Lock()
+			d.tokenSecrets = []string{newTokenSecret(), d.tokenSecrets[0]}
+			d.mu.Unlock()
+		case d.portRequest <- d.config.Port:
+			continue
+		case <-blocklistTicker:
+			d.mu.Lock()
+			d.checkBlocklist()
+			d.mu.Unlock()
+		case <-crawlTicker:
+			d.mu.Lock()
+			d.crawl()
+			d.mu.Unlock()
+		case <-saveTicker:
+			d.saveRoutingTable(false)
+		case <-d.saveRequest:
+			d.saveRoutingTable(true)
+		}
+	}
+}
+
+// saveRoutingTable 把可达的节点保存到Store中。除非force为true，可达节点太少时不保存，免得覆盖掉上次更好的路由表。
+func (d *DHT) saveRoutingTable(force bool) {
+	d.mu.Lock()
+	tbl := d.routingTable.reachableNodes()
+	d.mu.Unlock()
+	if len(tbl) > 5 || force {
+		d.store.Remotes = tbl
+		saveStore(d.storage, *d.store)
+	}
+}
+
+func (d *DHT) needMoreNodes() bool {
+	n := d.routingTable.numNodes()
+	return n < minNodes || n*2 < d.maxNodes()
+}
+
+func (d *DHT) helloFromPeer(addr string) {
+	if d.routingTable.length() >= d.maxNodes() {
+		return
+	}
+	r, err := d.contactNode(addr)
+	if err != nil {
+		log.V(3).Infof("DHT: helloFromPeer %v: %v", addr, err)
+		return
+	}
+	d.pingNode(r)
+}
+
+// isPendingReply 判断transId是不是我们发给addr的query(回复或错误回复)，这种包在限速时优先处理。
+// 调用者必须持有d.mu的读锁。
+func (d *DHT) isPendingReply(transId string, addr net.UDPAddr) bool {
+	if d.group != nil {
+		return d.group.replyOwner(transId, addr) != nil
+	}
+	_, ok := d.lookupQuery(transId, addr)
+	return ok
+}
+
+// decodePacket 检查来源、限速并解码，返回false表示包被丢掉了。
+// 它可以在收包的goroutine中并行运行，调用者不能持有d.mu。
+// 限速在解码之前：先拿一个普通的令牌，洪水中的包在这里就被丢掉，不用解码也不用加锁。
+// 普通的令牌用完之后，只有看起来是回复(peekReply)的包才对路由表加读锁，判断能不能使用保留的令牌。
+func (d *DHT) decodePacket(p packetType) (r responseType, ok bool) {
+	if !d.checkHost(p.raddr.IP) {
+		return r, false
+	}
+	if !d.recvBucket.allow(false) {
+		transId, reply := peekReply(p.b)
+		if !reply {
+			dropPacket(dropRateLimit)
+			return r, false
+		}
+		d.mu.RLock()
+		priority := d.isPendingReply(string(transId), p.raddr)
+		d.mu.RUnlock()
+		if !priority {
+			dropPacket(dropRateLimit)
+			return r, false
+		}
+		if !d.recvBucket.allow(true) {
+			dropPacket(dropRateLimitReply)
+			return r, false
+		}
+	}
+	r, err := readResponse(p)
+	if err != nil {
+		dropPacket(dropMalformed)
+		d.strikeHost(p.raddr.IP, strikeMalformed)
+		// 只有确定是query并且知道transaction ID时才回复错误。这个包已经通过了收包的限速，
+		// 所以伪造受害者地址的人不能让我们用整个发送预算向受害者反射回复。
+		if r.Y == "q" && r.T != "" {
+			d.replyError(p.raddr, r.T, ErrCodeProtocol, "malformed packet")
+		}
+		return r, false
+	}
+	if r.N != d.networkTag {
+		dropPacket(dropNetworkMismatch)
+		return r, false
+	}
+	return r, true
+}
+
+// handleMessage 处理一个已经解码的消息，必须在持有d.mu的情况下调用。
+// 如果replied为true，说明收包的goroutine已经回复过这个query了，这里只更新路由表。
+func (d *DHT) handleMessage(raddr net.UDPAddr, r responseType, replied bool) {
+	d.countStat("recv", 1)
+	if r.Y == "q" {
+		d.countQuery(r.Q)
+	}
+	switch r.Y {
+	case "r":
+		query, ok := d.lookupQuery(r.T, raddr)
+		if !ok {
+			log.V(4).Infof("DHT: unknown transaction %x from %v", r.T, raddr.String())
+			dropPacket(dropUnknownReply)
+			return
+		}
+		node := query.node
+		if d.routingTable.addresses[raddr.String()] != node && !d.admitProbe(node) {
+			// 发送query之后节点已经被删除了。
+			d.finishQuery(r.T, query)
+			dropPacket(dropUnknownReply)
+			return
+		}
+		if !node.reachable {
+			node.reachable = true
+			totalNodesReached.Add(1)
+		}
+		node.lastResponseTime = time.Now()
+		node.failures = 0
+		node.responses++
+		if r.V != "" {
+			node.version = r.V
+		}
+		d.voteExternalAddr(node, r.IP)
+		if !query.sent.IsZero() {
+			node.updateRTT(node.lastResponseTime.Sub(query.sent))
+		}
+		if node.id == "" && !bogusId(r.R.Id) {
+			node.id = r.R.Id
+			if err := d.routingTable.update(node, d.config.UDPProto); err != nil {
+				log.V(3).Infof("DHT: routingTable.update: %v", err)
+			}
+		}
+		if !bogusId(node.id) {
+			d.routingTable.neighborhoodUpkeep(node, d.config.UDPProto, d.peerStore)
+		}
+		switch query.Type {
+		case "ping":
+			totalRecvPingReply.Add(1)
+		case "get_peers":
+			d.processGetPeerResults(node, query, r)
+		case "find_node":
+			d.processFindNodeResults(node, query, r)
+		case "sample_infohashes":
+			d.processSampleResults(node, query, r)
+		case "announce_peer":
+			// 不需要处理
+		default:
+			log.V(3).Infof("DHT: unknown query type %q", query.Type)
+		}
+		d.finishQuery(r.T, query)
+		if query.crawl {
+			d.crawlFinished(node)
+		}
+	case "e":
+		d.processErrorReply(raddr, r)
+	case "q":
+		if bogusId(r.A.Id) {
+			log.V(3).Infof("DHT: query with bogus node id from %v", raddr.String())
+			d.replyError(raddr, r.T, ErrCodeProtocol, "invalid id")
+			return
+		}
+		// 和helloFromPeer一样，路由表满了就只更新已有的节点，否则伪造来源的query可以让路由表无限增长。
+		node, known := d.routingTable.addresses[raddr.String()]
+		if !known && d.routingTable.length() < d.maxNodes() {
+			var err error
+			if node, err = d.routingTable.getOrCreateNode(r.A.Id, raddr.String(), d.config.UDPProto); err != nil {
+				log.V(3).Infof("DHT: getOrCreateNode %v: %v", raddr.String(), err)
+			}
+		}
+		if node != nil && r.V != "" {
+			node.version = r.V
+		}
+		if replied {
+			return
+		}
+		switch r.Q {
+		case "ping":
+			d.replyPing(raddr, r)
+		case "get_peers":
+			d.replyGetPeers(raddr, r)
+		case "find_node":
+			d.replyFindNode(raddr, r)
+		case "sample_infohashes":
+			d.replySampleInfohashes(raddr, r)
+		case "announce_peer":
+			d.replyAnnouncePeer(raddr, r)
+		default:
+			log.V(3).Infof("DHT: unknown query %q from %v", r.Q, raddr.String())
+			d.replyError(raddr, r.T, ErrCodeMethodUnknown, "Method Unknown")
+		}
+	}
+}
+
+func (d *DHT) pingNode(r *remoteNode) {
+	totalSentPing.Add(1)
+	ty := "ping"
+	transId := d.newQuery(r, ty)
+	queryArguments := map[string]interface{}{"id": d.idFor(r.id)}
+	query := queryMessage{T: transId, Y: "q", Q: ty, A: queryArguments}
+	d.sendQuery(r, query)
+}
+
+func (d *DHT) findNode(id string) {
+	if len(id) != nodeIdLen {
+		log.V(1).Infof("DHT: ignoring find_node for invalid id %x", id)
+		return
+	}
+	closest := d.routingTable.lookupFiltered(InfoHash(id))
+	if len(closest) == 0 {
+		d.bootstrap()
+		return
+	}
+	for _, r := range closest {
+		d.findNodeFrom(r, id)
+	}
+}
+
+func (d *DHT) findNodeFrom(r *remoteNode, id string) *queryType {
+	if r == nil {
+		return nil
+	}
+	totalSentFindNode.Add(1)
+	ty := "find_node"
+	transId := d.newQuery(r, ty)
+	r.pendingQueries[transId].ih = InfoHash(id)
+	queryArguments := map[string]interface{}{
+		"id":     d.idFor(r.id),
+		"target": id,
+	}
+	query := queryMessage{T: transId, Y: "q", Q: ty, A: queryArguments}
+	r.lastSearchTime = time.Now()
+	return d.sendQuery(r, query)
+}
+
+func (d *DHT) announcePeer(address net.UDPAddr, ih InfoHash, token string) {
+	r, err := d.routingTable.getOrCreateNode("", address.String(), d.config.UDPProto)
+	if err != nil {
+		log.V(3).Infof("DHT: announcePeer getOrCreateNode %v: %v", address.String(), err)
+		return
+	}
+	totalSentAnnouncePeer.Add(1)
+	ty := "announce_peer"
+	transId := d.newQuery(r, ty)
+	r.pendingQueries[transId].ih = ih
+	port, implied := d.announceArgs(ih)
+	queryArguments := map[string]interface{}{
+		"id":        d.idFor(r.id),
+		"info_hash": ih,
+		"port":      port,
+		"token":     token,
+	}
+	if implied {
+		queryArguments["implied_port"] = 1
+	}
+	query := queryMessage{T: transId, Y: "q", Q: ty, A: queryArguments}
+	d.sendQuery(r, query)
+}
+
+// announcePort 返回announce_peer中宣布的端口。
+func (d *DHT) announcePort() int {
+	if d.config.AnnouncePort != 0 {
+		return d.config.AnnouncePort
+	}
+	return d.config.Port
+}
+
+func (d *DHT) hostToken(addr net.UDPAddr, secret string) string {
+	h := sha1.New()
+	io.WriteString(h, addr.String())
+	io.WriteString(h, secret)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func (d *DHT) checkToken(addr net.UDPAddr, token string) bool {
+	for _, secret := range d.tokenSecrets {
+		if d.hostToken(addr, secret) == token {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DHT) replyPing(addr net.UDPAddr, r responseType) {
+	reply := replyMessage{
+		T: r.T,
+		Y: "r",
+		R: map[string]interface{}{"id": d.idFor(r.A.Id)},
+	}
+	d.send(addr, reply)
+}
+
+// nodesForInfoHash 返回要回复给别人的节点，编码成紧凑的节点字符串(20字节id + 6字节地址)。
+// 一般是离ih最近的节点，路由器模式下是分散在ID空间中的节点。
+func (d *DHT) nodesForInfoHash(ih InfoHash) string {
+	if d.config.RouterMode {
+		return d.spreadNodes(ih)
+	}
+	return d.closestNodesString(ih)
+}
+
+// closestNodesString 返回离ih最近的节点，编码成紧凑的节点字符串。
+func (d *DHT) closestNodesString(ih InfoHash) string {
+	n := make([]string, 0, kNodes)
+	for _, r := range d.routingTable.lookup(ih) {
+		if r == nil || bogusId(r.id) || r.addressBinaryFormat == "" {
+			continue
+		}
+		n = append(n, r.id+r.addressBinaryFormat)
+	}
+	return strings.Join(n, "")
+}
+
+func (d *DHT) replyGetPeers(addr net.UDPAddr, r responseType) {
+	totalRecvGetPeers.Add(1)
+	ih := r.A.InfoHash
+	if len(ih) != 20 {
+		d.replyError(addr, r.T, ErrCodeProtocol, "invalid info_hash")
+		return
+	}
+	if d.Logger != nil {
+		d.Logger.GetPeers(addr, r.T, ih)
+	}
+	if d.crawler != nil {
+		d.foundInfoHash(ih, addr)
+	}
+	reply := replyMessage{
+		T: r.T,
+		Y: "r",
+		R: map[string]interface{}{
+			"id":    d.idFor(r.A.Id),
+			"token": d.hostToken(addr, d.tokenSecrets[0]),
+		},
+	}
+	if d.config.RouterMode {
+		reply.R["nodes"] = d.nodesForInfoHash(ih)
+	} else if peerContacts := d.peerStore.peerContacts(ih); len(peerContacts) > 0 {
+		reply.R["values"] = peerContacts
+	} else {
+		reply.R["nodes"] = d.nodesForInfoHash(ih)
+	}
+	d.send(addr, reply)
+}
+
+func (d *DHT) replyFindNode(addr net.UDPAddr, r responseType) {
+	totalRecvFindNode.Add(1)
+	if len(r.A.Target) != 20 {
+		d.replyError(addr, r.T, ErrCodeProtocol, "invalid target")
+		return
+	}
+	reply := replyMessage{
+		T: r.T,
+		Y: "r",
+		R: map[string]interface{}{
+			"id":    d.idFor(r.A.Id),
+			"nodes": d.nodesForInfoHash(InfoHash(r.A.Target)),
+		},
+	}
+	d.send(addr, reply)
+}
+
+func (d *DHT) replyAnnouncePeer(addr net.UDPAddr, r responseType) {
+	ih := r.A.InfoHash
+	port := r.A.Port
+	if r.A.ImpliedPort != 0 {
+		// BEP 5: implied_port不为0时忽略port，使用发送方的UDP源端口。
+		port = addr.Port
+	}
+	if len(ih) != 20 || port == 0 {
+		d.replyError(addr, r.T, ErrCodeProtocol, "invalid arguments")
+		return
+	}
+	if !d.checkToken(addr, r.A.Token) {
+		log.V(3).Infof("DHT: announce_peer with invalid token from %v", addr.String())
+		d.strikeHost(addr.IP, strikeBadToken)
+		d.replyError(addr, r.T, ErrCodeProtocol, "bad token")
+		return
+	}
+	peerAddr := net.UDPAddr{IP: addr.IP, Port: port}
+	if d.crawler != nil {
+		d.foundInfoHash(ih, addr)
+		d.foundPeer(ih, peerAddr)
+	} else if !d.config.RouterMode {
+		peerContact := nettools.DottedPortToBinary(peerAddr.String())
+		if d.peerStore.addContact(ih, peerContact, nettools.DottedPortToBinary(addr.String()), true) {
+			d.publishPeers(ih, []string{peerContact})
+		}
+	}
+	reply := replyMessage{
+		T: r.T,
+		Y: "r",
+		R: map[string]interface{}{"id": d.idFor(r.A.Id)},
+	}
+	d.send(addr, reply)
+}
+
+func (d *DHT) processGetPeerResults(node *remoteNode, query *queryType, resp responseType) {
+	totalRecvGetPeersReply.Add(1)
+	if d.wantsAnnounce(query.ih) && resp.R.Token != "" {
+		d.announcePeer(node.address, query.ih, resp.R.Token)
+	}
+	if resp.R.Values != nil {
+		peers := make([]string, 0)
+		for _, peerContact := range resp.R.Values {
+			if len(peerContact) < 6 {
+				continue
+			}
+			d.searchFound(query.ih, peerContact)
+			if d.peerStore.addContact(query.ih, peerContact, node.addressBinaryFormat, false) {
+				peers = append(peers, peerContact)
+			}
+		}
+		peers = familyPeers(peers, d.searchFamily(query.ih))
+		if len(peers) > 0 {
+			totalPeers.Add(int64(len(peers)))
+			d.countStat("peers", int64(len(peers)))
+			d.publishPeers(query.ih, peers)
+			if s := d.searches[query.ih]; s == nil || !s.background {
+				select {
+				case d.PeersRequestResults <- map[InfoHash][]string{query.ih: peers}:
+				default:
+					totalDroppedResults.Add(1)
+				}
+			}
+		}
+	}
+	if resp.R.Nodes == "" || d.searchDone(query.ih) {
+		return
+	}
+	for id, address := range parseNodesString(resp.R.Nodes, d.config.UDPProto, d.blocklist) {
+		if d.isOwnId(id) {
+			totalSelfPromotions.Add(1)
+			continue
+		}
+		_, addr, existed, err := d.routingTable.hostPortToNode(address, d.config.UDPProto)
+		if err != nil || addr == node.address.String() {
+			continue
+		}
+		if existed {
+			totalGetPeersDupes.Add(1)
+			continue
+		}
+		if nr, err := d.routingTable.getOrCreateNode(id, addr, d.config.UDPProto); err == nil {
+			d.getPeersFrom(nr, query.ih)
+		}
+	}
+}
+
+func (d *DHT) processFindNodeResults(node *remoteNode, query *queryType, resp responseType) {
+	totalRecvFindNodeReply.Add(1)
+	if resp.R.Nodes == "" {
+		return
+	}
+	if d.crawler != nil {
+		d.crawlNodes(node, resp.R.Nodes)
+		return
+	}
+	for id, address := range parseNodesString(resp.R.Nodes, d.config.UDPProto, d.blocklist) {
+		if d.isOwnId(id) {
+			totalSelfPromotions.Add(1)
+			continue
+		}
+		_, addr, existed, err := d.routingTable.hostPortToNode(address, d.config.UDPProto)
+		if err != nil || addr == node.address.String() {
+			continue
+		}
+		if existed {
+			totalFindNodeDupes.Add(1)
+			continue
+		}
+		if !d.needMoreNodes() {
+			continue
+		}
+		if nr, err := d.routingTable.getOrCreateNode(id, addr, d.config.UDPProto); err == nil {
+			d.findNodeFrom(nr, string(query.ih))
+		}
+	}
 }
 
 
@@ -249,9 +1101,13 @@ var (
 	totalFindNodeDupes = expvar.NewInt("totalFindNodeDupes")
 	totalSelfPromotions = expvar.NewInt("totalSelfPromotions")
 	totalPeers = expvar.NewInt("totalPeers")
+	totalDroppedResults = expvar.NewInt("totalDroppedResults")
+	totalExpiredPeers = expvar.NewInt("totalExpiredPeers")
+	totalPeerStoreEvictions = expvar.NewInt("totalPeerStoreEvictions")
 	totalSentPing = expvar.NewInt("totalSentPing")
 	totalSentGetPeers = expvar.NewInt("totalSentGetPeers")
 	totalSentFindNode = expvar.NewInt("totalSentFindNode")
+	totalSentAnnouncePeer = expvar.NewInt("totalSentAnnouncePeer")
 	totalRecvGetPeers = expvar.NewInt("totalRecvGetPeers")
 	totalRecvGetPeersReply = expvar.NewInt("totalRecvGetPeersReply")
 	totalRecvPingReply = expvar.NewInt("totalRecvPingReply")
@@ -261,14 +1117,3 @@ var (
 	totalDroppedPackets = expvar.NewInt("totalDroppedPackets")
 	totalRecv = expvar.NewInt("totalRecv")
 )
-
-
-
-
-
-
-
-
-
-
-
@@ -0,0 +1,85 @@
+package dht
+
+import (
+	"expvar"
+	"time"
+)
+
+/*
+	长时间运行的torrent客户端的下载。
+	AddDownload()把一个infohash记为本地下载，并开始一个每隔downloadSearchPeriod(有随机抖动)重复的查找，
+	每一轮都会向回复了token的节点重新宣布我们的端口，直到RemoveDownload()。
+	本地下载的peer在它的地址作为DHT节点被删除时会被标记为死了(peerStore.killContact)，排到其他peer后面。
+	SubscribePeers()订阅一个infohash新发现的peer，包括查找得到的和别人announce_peer宣布的。
+	下载的查找找到的peer只发给订阅者，不发到PeersRequestResults。
+	订阅的channel满了时新的peer会被丢掉，不会阻塞主goroutine，所以订阅者应该尽快读取，漏掉的peer可以用PeersFor()补上。
+ */
+
+const (
+	downloadSearchPeriod = 15 * time.Minute
+	subscriptionBuffer   = 16
+)
+
+// AddDownload 把ih记为本地下载，定期查找它的peer并宣布我们在port上下载它，port为0时使用Config.AnnouncePort或DHT的端口。
+// 对同一个ih再次调用会替换port并马上开始新的一轮。
+func (d *DHT) AddDownload(ih string, port int) {
+	opts := SearchOptions{Announce: true, Port: port, Repeat: downloadSearchPeriod}
+	d.peersRequest <- ihReq{ih: InfoHash(ih), opts: opts, download: true, background: true}
+}
+
+// RemoveDownload 停止ih的定期查找和宣布，已经保存的peer会照常过期。用Search()另外开始的查找不受影响。
+func (d *DHT) RemoveDownload(ih string) {
+	d.peersRequest <- ihReq{ih: InfoHash(ih), download: true, cancel: true}
+}
+
+// PeerSubscription 接收一个infohash新发现的peer，应该用SubscribePeers()来创建。
+type PeerSubscription struct {
+	C  <-chan []string // 新的peer，二进制格式，和PeersRequestResults一样
+	c  chan []string
+	ih InfoHash
+	d  *DHT
+}
+
+// SubscribePeers 订阅ih新发现的peer，不再需要时必须调用Close()。
+func (d *DHT) SubscribePeers(ih string) *PeerSubscription {
+	c := make(chan []string, subscriptionBuffer)
+	s := &PeerSubscription{C: c, c: c, ih: InfoHash(ih), d: d}
+	d.mu.Lock()
+	d.subscriptions[s.ih] = append(d.subscriptions[s.ih], s)
+	d.mu.Unlock()
+	return s
+}
+
+// Close 取消订阅并关闭C，可以调用多次。
+func (s *PeerSubscription) Close() {
+	d := s.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	subs := d.subscriptions[s.ih]
+	for i, sub := range subs {
+		if sub != s {
+			continue
+		}
+		subs = append(subs[:i], subs[i+1:]...)
+		if len(subs) == 0 {
+			delete(d.subscriptions, s.ih)
+		} else {
+			d.subscriptions[s.ih] = subs
+		}
+		close(s.c)
+		return
+	}
+}
+
+// publishPeers 把ih新发现的peer发给订阅者，订阅者的channel满了就丢掉。必须在持有d.mu的情况下调用。
+func (d *DHT) publishPeers(ih InfoHash, peers []string) {
+	for _, s := range d.subscriptions[ih] {
+		select {
+		case s.c <- peers:
+		default:
+			totalDroppedSubscriptionPeers.Add(int64(len(peers)))
+		}
+	}
+}
+
+var totalDroppedSubscriptionPeers = expvar.NewInt("totalDroppedSubscriptionPeers")
@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"encoding/binary"
+	"expvar"
+	"net"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/golang/groupcache/lru"
+)
+
+/*
+	外部地址。
+	按照BEP 42，回复里的"ip"字段是请求者的紧凑地址(IPv4是6个字节，IPv6是18个字节)。
+	我们在每个回复里带上对方的地址，同时收集别人回复我们的query时带来的地址，
+	每个IP只算一票(只记最后一次)，得票最多的就是我们的外部地址，通过DHT.ExternalAddr()读取。
+	如果外部端口和监听的端口不一样，说明我们在一个会改端口的NAT后面。
+ */
+
+const (
+	maxExternalAddrVoters = 256 // 只记住最近这么多个投票的节点
+	minExternalAddrVotes  = 3   // 至少这么多票才认为外部地址是可信的
+)
+
+var externalAddrVar = expvar.NewString("externalAddr")
+
+// compactAddr 把addr编码成紧凑格式：IP加上大端序的端口。
+func compactAddr(addr net.UDPAddr) string {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	if ip == nil {
+		return ""
+	}
+	b := make([]byte, len(ip)+2)
+	copy(b, ip)
+	binary.BigEndian.PutUint16(b[len(ip):], uint16(addr.Port))
+	return string(b)
+}
+
+// parseCompactAddr 是compactAddr的反向操作。
+func parseCompactAddr(s string) (net.UDPAddr, bool) {
+	if len(s) != 6 && len(s) != 18 {
+		return net.UDPAddr{}, false
+	}
+	n := len(s) - 2
+	ip := make(net.IP, n)
+	copy(ip, s[:n])
+	return net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16([]byte(s[n:])))}, true
+}
+
+type externalAddrVoter struct {
+	mu     sync.Mutex
+	voters *lru.Cache // key: 投票节点的IP, value: 它报告的紧凑地址
+	votes  map[string]int
+	best   string
+}
+
+func newExternalAddrVoter() *externalAddrVoter {
+	v := &externalAddrVoter{votes: make(map[string]int)}
+	v.voters = lru.New(maxExternalAddrVoters)
+	v.voters.OnEvicted = func(_ lru.Key, value interface{}) {
+		v.unvote(value.(string))
+	}
+	return v
+}
+
+func (v *externalAddrVoter) unvote(addr string) {
+	if v.votes[addr]--; v.votes[addr] <= 0 {
+		delete(v.votes, addr)
+	}
+}
+
+// vote 记录voter报告的地址，如果得票最多的地址变了，返回true。
+func (v *externalAddrVoter) vote(voter string, addr string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if old, ok := v.voters.Get(voter); ok {
+		if old.(string) == addr {
+			return false
+		}
+		v.unvote(old.(string))
+	}
+	v.voters.Add(voter, addr)
+	v.votes[addr]++
+	best, n := "", 0
+	for a, c := range v.votes {
+		if c > n || (c == n && a == v.best) {
+			best, n = a, c
+		}
+	}
+	if n < minExternalAddrVotes {
+		best = ""
+	}
+	changed := best != v.best
+	v.best = best
+	return changed
+}
+
+func (v *externalAddrVoter) get() (net.UDPAddr, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return parseCompactAddr(v.best)
+}
+
+// voteExternalAddr 记录节点r在回复中报告的我们的地址。
+func (d *DHT) voteExternalAddr(r *remoteNode, ip string) {
+	if _, ok := parseCompactAddr(ip); !ok {
+		return
+	}
+	if !d.externalAddr.vote(r.address.IP.String(), ip) {
+		return
+	}
+	addr, ok := d.externalAddr.get()
+	if !ok {
+		// 票数不够了，不再显示旧的地址。
+		externalAddrVar.Set("")
+		log.V(1).Infof("DHT: external address is unknown again")
+		return
+	}
+	externalAddrVar.Set(addr.String())
+	log.V(1).Infof("DHT: external address is now %v", addr.String())
+	if addr.Port != d.config.Port {
+		log.V(1).Infof("DHT: external port %d differs from local port %d, we are probably behind a NAT that rewrites ports", addr.Port, d.config.Port)
+	}
+}
+
+// ExternalAddr 返回其他节点看到的我们的地址。还没有足够多的节点报告时，ok为false。可以在任何goroutine中调用。
+func (d *DHT) ExternalAddr() (addr net.UDPAddr, ok bool) {
+	return d.externalAddr.get()
+}
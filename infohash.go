@@ -0,0 +1,151 @@
+package dht
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	v2InfoHashLen = 32 // BitTorrent v2(BEP 52)的infohash是SHA-256
+	// btmh的multihash前缀：0x12是sha2-256，0x20是长度32。
+	sha256MultihashPrefix = "1220"
+)
+
+// Valid 判断ih是不是20个字节，DHT中只能使用这个长度的infohash。
+func (ih InfoHash) Valid() bool {
+	return len(ih) == nodeIdLen
+}
+
+// Hex 返回ih的十六进制形式，给日志和用户界面用。
+// InfoHash没有String()方法，因为很多日志用%x打印它，有了String()之后%x就会打印十六进制的十六进制。
+func (ih InfoHash) Hex() string {
+	return hex.EncodeToString([]byte(ih))
+}
+
+// Base32 返回ih的base32形式，一些magnet链接使用这种编码。
+func (ih InfoHash) Base32() string {
+	return base32.StdEncoding.EncodeToString([]byte(ih))
+}
+
+// DecodeInfoHash 把40个十六进制字符解码成InfoHash。
+func DecodeInfoHash(x string) (b InfoHash, err error) {
+	var h []byte
+	h, err = hex.DecodeString(x)
+	if err != nil {
+		return "", fmt.Errorf("DecodeInfoHash: %v", err)
+	}
+	if len(h) != 20 {
+		return "", fmt.Errorf("DecodeInfoHash: expected InfoHash len=20, got %d", len(h))
+	}
+	return InfoHash(h), nil
+}
+
+// DecodeBase32InfoHash 把32个base32字符解码成InfoHash，不区分大小写。
+func DecodeBase32InfoHash(x string) (InfoHash, error) {
+	h, err := base32.StdEncoding.DecodeString(strings.ToUpper(x))
+	if err != nil {
+		return "", fmt.Errorf("DecodeBase32InfoHash: %v", err)
+	}
+	if len(h) != 20 {
+		return "", fmt.Errorf("DecodeBase32InfoHash: expected InfoHash len=20, got %d", len(h))
+	}
+	return InfoHash(h), nil
+}
+
+// V2InfoHash 把v2的SHA-256 infohash截短成DHT中使用的20字节的key(BEP 52)。
+func V2InfoHash(sha256 []byte) (InfoHash, error) {
+	if len(sha256) != v2InfoHashLen {
+		return "", fmt.Errorf("V2InfoHash: expected SHA-256 len=32, got %d", len(sha256))
+	}
+	return InfoHash(sha256[:nodeIdLen]), nil
+}
+
+// Magnet 是解析后的magnet链接。
+type Magnet struct {
+	InfoHash InfoHash // 在DHT中查找用的infohash，只有btmh时是截短的v2 infohash
+	V2       []byte   // btmh中完整的SHA-256 infohash，没有btmh时为nil
+	Name     string   // dn，显示的名字
+	Trackers []string // tr
+	Peers    []string // x.pe，"host:port"形式的peer地址
+}
+
+// ParseMagnet 解析magnet链接。xt可以是urn:btih:(十六进制或base32)和urn:btmh:(sha2-256的multihash)，至少要有一个。
+// 两个都有时(混合torrent)InfoHash取自btih。
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("ParseMagnet: not a magnet URI: %q", uri)
+	}
+	q := u.Query()
+	m := &Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+		Peers:    q["x.pe"],
+	}
+	for _, xt := range q["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			if m.InfoHash, err = decodeBtih(strings.TrimPrefix(xt, "urn:btih:")); err != nil {
+				return nil, fmt.Errorf("ParseMagnet: %v", err)
+			}
+		case strings.HasPrefix(xt, "urn:btmh:"):
+			mh := strings.ToLower(strings.TrimPrefix(xt, "urn:btmh:"))
+			if !strings.HasPrefix(mh, sha256MultihashPrefix) {
+				return nil, fmt.Errorf("ParseMagnet: unsupported multihash in %q", xt)
+			}
+			if m.V2, err = hex.DecodeString(mh[len(sha256MultihashPrefix):]); err != nil {
+				return nil, fmt.Errorf("ParseMagnet: %v", err)
+			}
+			if len(m.V2) != v2InfoHashLen {
+				return nil, fmt.Errorf("ParseMagnet: expected SHA-256 len=32 in btmh, got %d", len(m.V2))
+			}
+		}
+	}
+	if m.InfoHash == "" && m.V2 != nil {
+		m.InfoHash, _ = V2InfoHash(m.V2)
+	}
+	if m.InfoHash == "" {
+		return nil, fmt.Errorf("ParseMagnet: no urn:btih or urn:btmh in %q", uri)
+	}
+	return m, nil
+}
+
+// decodeBtih 解码urn:btih:后面的infohash，32个字符的是base32，40个字符的是十六进制。
+func decodeBtih(h string) (InfoHash, error) {
+	if len(h) == 32 {
+		return DecodeBase32InfoHash(h)
+	}
+	return DecodeInfoHash(h)
+}
+
+// InfoHashFromMagnet 从magnet链接中取出在DHT中查找用的infohash，见ParseMagnet()。
+func InfoHashFromMagnet(uri string) (InfoHash, error) {
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		return "", err
+	}
+	return m.InfoHash, nil
+}
+
+// ParseInfoHash 接受magnet链接、40个十六进制字符、32个base32字符，或者64个十六进制字符的v2 infohash(会被截短)。
+func ParseInfoHash(s string) (InfoHash, error) {
+	switch {
+	case strings.HasPrefix(s, "magnet:"):
+		return InfoHashFromMagnet(s)
+	case len(s) == 32:
+		return DecodeBase32InfoHash(s)
+	case len(s) == 2*v2InfoHashLen:
+		h, err := hex.DecodeString(s)
+		if err != nil {
+			return "", fmt.Errorf("ParseInfoHash: %v", err)
+		}
+		return V2InfoHash(h)
+	}
+	return DecodeInfoHash(s)
+}
@@ -0,0 +1,112 @@
+package dht
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+const testHexInfoHash = "0123456789abcdef0123456789abcdef01234567"
+
+var (
+	testInfoHash, _ = DecodeInfoHash(testHexInfoHash)
+	testV2Sum       = sha256.Sum256([]byte("v2"))
+	testV2Hex       = hex.EncodeToString(testV2Sum[:])
+	testV2InfoHash  = InfoHash(testV2Sum[:nodeIdLen])
+)
+
+func TestParseInfoHash(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want InfoHash
+	}{
+		{"hex", testHexInfoHash, testInfoHash},
+		{"upper case hex", strings.ToUpper(testHexInfoHash), testInfoHash},
+		{"base32", testInfoHash.Base32(), testInfoHash},
+		{"lower case base32", strings.ToLower(testInfoHash.Base32()), testInfoHash},
+		{"v2 hex", testV2Hex, testV2InfoHash},
+		{"btih magnet", "magnet:?xt=urn:btih:" + testHexInfoHash, testInfoHash},
+		{"base32 btih magnet", "magnet:?xt=urn:btih:" + testInfoHash.Base32(), testInfoHash},
+		{"btmh magnet", "magnet:?xt=urn:btmh:1220" + testV2Hex, testV2InfoHash},
+		{"hybrid magnet", "magnet:?xt=urn:btmh:1220" + testV2Hex + "&xt=urn:btih:" + testHexInfoHash, testInfoHash},
+		{"unknown xt is ignored", "magnet:?xt=urn:sha1:abc&xt=urn:btih:" + testHexInfoHash, testInfoHash},
+	}
+	for _, tt := range tests {
+		got, err := ParseInfoHash(tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseInfoHashRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"empty", ""},
+		{"short hex", testHexInfoHash[:38]},
+		{"long hex", testHexInfoHash + "00"},
+		{"odd hex", testHexInfoHash[:39]},
+		{"bad hex character", "x" + testHexInfoHash[1:]},
+		{"bad base32 character", "1" + testInfoHash.Base32()[1:]},
+		{"bad v2 hex character", "x" + testV2Hex[1:]},
+		{"magnet without xt", "magnet:?dn=foo"},
+		{"magnet with unknown xt only", "magnet:?xt=urn:sha1:abc"},
+		{"short btih", "magnet:?xt=urn:btih:" + testHexInfoHash[:38]},
+		{"bad btih", "magnet:?xt=urn:btih:zz"},
+		{"btmh with another multihash", "magnet:?xt=urn:btmh:1114" + testV2Hex},
+		{"short btmh", "magnet:?xt=urn:btmh:1220" + testV2Hex[:62]},
+		{"bad btmh character", "magnet:?xt=urn:btmh:1220x" + testV2Hex[1:]},
+		{"bad btih with good btmh", "magnet:?xt=urn:btih:zz&xt=urn:btmh:1220" + testV2Hex},
+		{"not a magnet", "http://example.com/?xt=urn:btih:" + testHexInfoHash},
+	}
+	for _, tt := range tests {
+		if got, err := ParseInfoHash(tt.in); err == nil {
+			t.Errorf("%s: got %x, want an error", tt.name, got)
+		}
+	}
+}
+
+func TestParseMagnet(t *testing.T) {
+	m, err := ParseMagnet("magnet:?xt=urn:btih:" + testHexInfoHash + "&xt=urn:btmh:1220" + testV2Hex +
+		"&dn=foo+bar&tr=udp%3A%2F%2Ft1%3A80&tr=http%3A%2F%2Ft2%2Fannounce&x.pe=1.2.3.4:5&x.pe=[::1]:6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.InfoHash != testInfoHash || hex.EncodeToString(m.V2) != testV2Hex || m.Name != "foo bar" {
+		t.Fatalf("%+v", m)
+	}
+	if len(m.Trackers) != 2 || m.Trackers[0] != "udp://t1:80" || m.Trackers[1] != "http://t2/announce" {
+		t.Fatalf("trackers: %q", m.Trackers)
+	}
+	if len(m.Peers) != 2 || m.Peers[0] != "1.2.3.4:5" || m.Peers[1] != "[::1]:6" {
+		t.Fatalf("peers: %q", m.Peers)
+	}
+
+	// 只有btih时没有V2。
+	if m, err = ParseMagnet("magnet:?xt=urn:btih:" + testHexInfoHash); err != nil || m.V2 != nil {
+		t.Fatalf("%+v, %v", m, err)
+	}
+}
+
+func TestInfoHashEncodings(t *testing.T) {
+	if !testInfoHash.Valid() || InfoHash("short").Valid() {
+		t.Fatal("Valid")
+	}
+	if testInfoHash.Hex() != testHexInfoHash {
+		t.Fatal(testInfoHash.Hex())
+	}
+	if got, err := DecodeBase32InfoHash(testInfoHash.Base32()); err != nil || got != testInfoHash {
+		t.Fatal(got, err)
+	}
+	if _, err := V2InfoHash(testV2Sum[:31]); err == nil {
+		t.Fatal("V2InfoHash accepted 31 bytes")
+	}
+}
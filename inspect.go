@@ -0,0 +1,165 @@
+package dht
+
+import (
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/nettools"
+)
+
+/*
+	路由表和peerStore的只读快照，给仪表盘和调试工具用。
+	remoteNode、routingTable和nTree都只能在主goroutine中修改，这里的函数加锁后把需要的字段复制出来，
+	返回的值和内部状态没有共享，可以在任何goroutine中调用，也可以随意修改。
+ */
+
+// Node 是路由表中一个节点的快照。
+type Node struct {
+	ID           string // 十六进制，还不知道ID时为空
+	Address      string // host:port
+	Reachable    bool
+	LastResponse time.Time // 从来没有回复过时是零值
+	RTT          time.Duration // 平滑后的往返时间，0表示还没有样本
+	Version      string // 节点发来的"v"字段
+}
+
+// TableStats 是路由表的统计信息。
+type TableStats struct {
+	Nodes     int
+	Reachable int
+	Proximity int // 邻居中最远的节点和我们的ID的共同前缀位数
+	// Depths[i]是和我们的ID正好有i个共同前缀位的节点数，相当于Kademlia的第i个桶。还不知道ID的节点不计算在内。
+	Depths []int
+}
+
+func nodeSnapshot(r *remoteNode) Node {
+	return Node{
+		ID:           hex.EncodeToString([]byte(r.id)),
+		Address:      r.address.String(),
+		Reachable:    r.reachable,
+		LastResponse: r.lastResponseTime,
+		RTT:          r.rtt,
+		Version:      r.version,
+	}
+}
+
+// Nodes 返回路由表中所有节点的快照，按地址排序。
+func (d *DHT) Nodes() []Node {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	ret := make([]Node, 0, len(d.routingTable.addresses))
+	for _, r := range d.routingTable.addresses {
+		ret = append(ret, nodeSnapshot(r))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Address < ret[j].Address })
+	return ret
+}
+
+// ClosestNodes 返回路由表中离target最近的最多k个节点，从近到远排序。target必须是20个字节。
+func (d *DHT) ClosestNodes(target InfoHash, k int) []Node {
+	if len(target) != nodeIdLen || k <= 0 {
+		return nil
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	closest := d.routingTable.traverse(target, 0, make([]*remoteNode, 0, k), false, k)
+	ret := make([]Node, 0, len(closest))
+	for _, r := range closest {
+		ret = append(ret, nodeSnapshot(r))
+	}
+	return ret
+}
+
+// TableStats 返回路由表的统计信息。
+func (d *DHT) TableStats() TableStats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	s := TableStats{Nodes: len(d.routingTable.addresses), Proximity: d.routingTable.proximity}
+	depths := make([]int, nodeIdLen*8+1)
+	max := -1
+	for _, r := range d.routingTable.addresses {
+		if r.reachable {
+			s.Reachable++
+		}
+		if bogusId(r.id) {
+			continue
+		}
+		b := commonBits(d.nodeId, r.id)
+		depths[b]++
+		if b > max {
+			max = b
+		}
+	}
+	s.Depths = depths[:max+1]
+	return s
+}
+
+// PeersFor 返回peerStore中ih所有还活着的peer，格式是host:port。
+func (d *DHT) PeersFor(ih InfoHash) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	contacts := d.peerStore.alivePeers(ih)
+	ret := make([]string, 0, len(contacts))
+	for _, c := range contacts {
+		ret = append(ret, nettools.BinaryToDottedPort(c))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// PeerInfo 是peerStore中一个peer的快照。
+type PeerInfo struct {
+	Address   string // host:port
+	FirstSeen time.Time
+	LastSeen  time.Time // 超过30分钟没有再次见到的peer会被删除
+	Sources   int       // 在get_peers的回复中给过我们这个peer的不同节点数(近似值)，最多8
+	Announced bool      // peer自己向我们发送过announce_peer
+	Alive     bool      // false表示同一个地址的DHT节点已经死了
+}
+
+// PeerInfos 返回peerStore中ih所有没有过期的peer和它们的元数据，按地址排序。
+func (d *DHT) PeerInfos(ih InfoHash) []PeerInfo {
+	d.mu.RLock()
+	infos := d.peerStore.peerInfos(ih)
+	d.mu.RUnlock()
+	ret := make([]PeerInfo, 0, len(infos))
+	for c, info := range infos {
+		ret = append(ret, PeerInfo{
+			Address:   nettools.BinaryToDottedPort(c),
+			FirstSeen: info.firstSeen,
+			LastSeen:  info.lastSeen,
+			Sources:   info.sourceCount(),
+			Announced: info.announced,
+			Alive:     info.alive,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Address < ret[j].Address })
+	return ret
+}
+
+// PeerStoreStats 是peerStore的内存统计。
+type PeerStoreStats struct {
+	InfoHashes int
+	Peers      int
+	Bytes      int // 估计占用的内存
+	MaxBytes   int // Config.PeerStoreBytes，0表示不限制
+}
+
+// PeerStoreStats 返回peerStore的统计信息。
+func (d *DHT) PeerStoreStats() PeerStoreStats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	s := PeerStoreStats{InfoHashes: len(d.peerStore.index), Bytes: d.peerStore.bytes, MaxBytes: d.peerStore.maxBytes}
+	for _, peers := range d.peerStore.index {
+		s.Peers += peers.Size()
+	}
+	return s
+}
+
+// InfoHashBytes 返回peerStore中ih的peer估计占用的内存，没有ih时返回0。
+func (d *DHT) InfoHashBytes(ih InfoHash) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.peerStore.infoHashBytes(ih)
+}
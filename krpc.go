@@ -4,12 +4,8 @@ import (
 	"time"
 	"net"
 	"github.com/nettools"
-	"crypto/rand"
 	"expvar"
 	"github.com/youtube/vitess/go/vt/log"
-	"strconv"
-	"bytes"
-	"github.com/jackpal/bencode-go"
 )
 
 // 每经过15秒就找一次节点
@@ -32,12 +28,17 @@ type remoteNode struct {
 	address net.UDPAddr
 	addressBinaryFormat string
 	id string
-	lastQueryID int  						// lastQueryID需要在消费后自增。根据协议，应该是两个字母，但我使用0-255，虽然是当作字符串
 	pendingQueries map[string]*queryType	// key: transaction ID
 	pastQueries map[string]*queryType		// key: transaction ID
 	reachable bool
 	lastResponseTime time.Time
 	lastSearchTime time.Time
+	rtt time.Duration 						// 平滑后的往返时间，0表示还没有样本
+	failures int 							// 连续超时的次数，收到任何回复就清零
+	queries int 							// 发给这个节点的query数
+	responses int 							// 收到的回复数(包括错误回复)
+	firstSeen time.Time 					// 节点被创建的时间
+	version string 							// 节点最后一次发来的"v"字段，也就是客户端版本
 	ActiveDownloads []string
 }
 
@@ -47,6 +48,22 @@ type queryType struct {
 	Type string
 	ih InfoHash
 	srcNode string
+	sent time.Time 		// 发送的时间，用来计算RTT
+	retry bool 			// 这是一次失败后的重试，再失败就不再重试
+	node *remoteNode 	// query发给的节点
+	crawl bool 			// 爬虫访问节点的query，结束后可能删除这个节点
+}
+
+// updateRTT 用一个新的样本更新平滑RTT(和TCP一样，新样本的权重是1/8)。
+func (r *remoteNode) updateRTT(sample time.Duration) {
+	if sample <= 0 {
+		return
+	}
+	if r.rtt == 0 {
+		r.rtt = sample
+		return
+	}
+	r.rtt = r.rtt - r.rtt/8 + sample/8
 }
 
 type getPeersResponse struct {
@@ -55,6 +72,9 @@ type getPeersResponse struct {
 	Nodes string "nodes"
 	Nodes6 string "nodes6"
 	Token string "token"
+	Samples string "samples"
+	Num int "num"
+	Interval int "interval"
 }
 
 type answerType struct {
@@ -62,6 +82,7 @@ type answerType struct {
 	Target string "target"
 	InfoHash InfoHash "info_hash"
 	Port int "port"
+	ImpliedPort int "implied_port"
 	Token string "token"
 }
 
@@ -69,8 +90,11 @@ type responseType struct {
 	T string "t"
 	Y string "y"
 	Q string "q"
+	V string "v"
+	IP string "ip"
+	N string "n"
 	R getPeersResponse "r"
-	E []string "e"
+	E KRPCError "e"
 	A answerType "a"
 }
 
@@ -79,12 +103,17 @@ type queryMessage struct {
 	Y string "y"
 	Q string "q"
 	A map[string]interface{} "a"
+	V string "v"
+	N string "n"
 }
 
 type replyMessage struct {
 	T string "t"
 	Y string "y"
 	R map[string]interface{} "r"
+	V string "v"
+	IP string "ip"
+	N string "n"
 }
 
 type packetType struct{
@@ -92,8 +121,8 @@ type packetType struct{
 	raddr net.UDPAddr
 }
 
-// 参数nodes是一个固定长度的包含任意连接的字符串
-func parseNodesString(nodes string,proto string) (parsed map[string]string){
+// 参数nodes是一个固定长度的包含任意连接的字符串，在黑名单bl中的节点会被跳过。
+func parseNodesString(nodes string,proto string,bl *blocklist) (parsed map[string]string){
 	var nodeContactLen int
 	if proto == "udp4"{
 		nodeContactLen = v4nodeContactLen
@@ -112,22 +141,15 @@ func parseNodesString(nodes string,proto string) (parsed map[string]string){
 	}
 	for i := 0;i<len(nodes);i+=nodeContactLen{
 		id := nodes[i:i+nodeIdLen]
+		if bl.blocked(net.IP(nodes[i+nodeIdLen:i+nodeContactLen-2])) {
+			continue
+		}
 		address := nettools.BinaryToDottedPort(nodes[i+nodeIdLen:i+nodeContactLen])
 		parsed[id] = address
 	}
 	return
 }
 
-// newQuery 创建一个新的事务id并向r.pendingQueries添加一个条目。它不会为事务信息设置任何额外的信息，所以调用者必须处理它。
-func (r *remoteNode) newQuery(transType string) (transId string){
-	log.V(4).Infof("newQuery for %x, lastID %v", r.id, r.lastQueryID)
-	r.lastQueryID = (r.lastQueryID+1)%256
-	transId = strconv.Itoa(r.lastQueryID)
-	log.V(4).Infof("... new id %v", r.lastQueryID)
-	r.pendingQueries[transId] = &queryType{Type:transType}
-	return
-}
-
 // 如果一个节点最近被联系过，也就是说最近被infohash请求过，返回true，如果每次请求都使用不同的infohash，就返回false
 func (r *remoteNode) wasContactedRecently(ih InfoHash) bool {
 	if len(r.pendingQueries) == 0 && len(r.pastQueries) == 0 {
@@ -160,47 +182,95 @@ func newRemoteNode(addr net.UDPAddr,id string) *remoteNode {
 	return &remoteNode{
 		address:addr,
 		addressBinaryFormat:nettools.DottedPortToBinary(addr.String()),
-		lastQueryID:newTransactionId(),
 		id:id,
 		reachable:false,
+		firstSeen:time.Now(),
 		pendingQueries:map[string]*queryType{},
 		pastQueries:map[string]*queryType{},
 	}
 }
-func newTransactionId() int {
-	n,err := rand.Read(make([]byte,1))
+func sendMsg(conn packetConn,raddr net.UDPAddr,query krpcMessage) bool {
+	totalSent.Add(1)
+	b,err := query.appendTo(make([]byte,0,512))
 	if err != nil {
-		return time.Now().Second()
+		log.V(3).Infof("DHT: failed to encode message to %+v: %v", raddr, err)
+		return false
+	}
+	if len(b) > maxPayload(conn) {
+		log.V(3).Infof("DHT: message to %+v too large: %d bytes", raddr, len(b))
+		return false
+	}
+	n,err := conn.WriteToUDP(b,&raddr)
+	if err != nil{
+		log.V(3).Infof("DHT: node write failed to %+v, error=%s", raddr, err)
+		return false
 	}
-	return n
+	totalWrittenBytes.Add(int64(n))
+	return true
 }
 
-func sendMsg(conn *net.UDPConn,raddr net.UDPAddr,query interface{}){
-	totalSent.Add(1)
-	var b bytes.Buffer
-	if err := bencode.Marshal(&b,query);err != nil {
-		return
+// listen 在address:port上打开一个UDP socket，address为空时监听所有地址。
+func listen(address string,port int,proto string) (*net.UDPConn,error) {
+	addr := net.UDPAddr{IP:net.ParseIP(address),Port:port}
+	conn,err := net.ListenUDP(proto,&addr)
+	if err != nil {
+		return nil,err
 	}
-	if n,err := conn.WriteToUDP(b.Bytes(),&raddr);err != nil{
-		log.V(3).Infof("DHT: node write failed to %+v, error=%s", raddr, err)
-	}else{
-		totalWrittenBytes.Add(int64(n))
+	return conn,nil
+}
+
+// readFromSocket 不停地从socket读取数据包并发给conChan，直到stop被关闭。
+// 数据包读到bytesArena的block中，接收者处理完之后负责把block Push回去。arena用完时，
+// 如果block为true就等待有block被还回来，否则把包读到一个临时缓冲区然后丢掉。
+func readFromSocket(socket packetConn,conChan chan packetType,bytesArena arena,block bool,stop chan bool) {
+	scratch := make([]byte,maxUDPPacketSize)
+	for {
+		b,ok := bytesArena.TryPop()
+		if !ok && block {
+			if b,ok = bytesArena.PopWait(stop);!ok {
+				return
+			}
+		}
+		buf := b
+		if !ok {
+			buf = scratch
+		}
+		n,addr,err := socket.ReadFromUDP(buf)
+		if err != nil || n == 0 || !ok {
+			if ok {
+				bytesArena.Push(b)
+			}
+			if err != nil {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				log.V(3).Infof("DHT: readResponse error:%s", err)
+			} else if !ok {
+				totalReadBytes.Add(int64(n))
+				dropPacket(dropArenaFull)
+			}
+			continue
+		}
+		b = b[0:n]
+		if n == maxUDPPacketSize {
+			log.V(3).Infof("Warning. Received packet with len >= %d, some data may have been discarded.", maxUDPPacketSize)
+		}
+		totalReadBytes.Add(int64(n))
+		select {
+		case conChan <- packetType{b,*addr}:
+		case <-stop:
+			bytesArena.Push(b)
+			return
+		}
 	}
-	return
 }
 
 func readResponse(p packetType) (response responseType,err error){
-	defer func(){
-		if x := recover();x!=nil{
-			log.V(3).Infof("DHT: !!! Recovering from panic() after bencode.Unmarshal %q, %v", string(p.b), x)
-		}
-	}()
-	if e2 := bencode.Unmarshal(bytes.NewBuffer(p.b),&response);e2==nil{
-		err = nil
-		return
-	}else{
-		log.V(3).Infof("DHT: unmarshal error, odd or partial data during UDP read? %v, err=%s", string(p.b), e2)
-		return response, e2
+	if err = decodeMessage(p.b,&response);err != nil {
+		log.V(3).Infof("DHT: decode error, odd or partial data during UDP read? %q, err=%s", string(p.b), err)
+		return response,err
 	}
 	return
 }
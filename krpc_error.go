@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// BEP 5定义的错误码
+const (
+	ErrCodeGeneric       = 201 // 一般错误
+	ErrCodeServer        = 202 // 服务器错误
+	ErrCodeProtocol      = 203 // 协议错误，例如格式不对的包、无效的参数或者错误的token
+	ErrCodeMethodUnknown = 204 // 未知的方法
+)
+
+// KRPCError 是y=e的错误消息，"e"是一个列表，第一个元素是整数错误码，第二个是错误信息。
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+type errorMessage struct {
+	T string
+	Y string
+	E KRPCError
+	V string
+	N string
+}
+
+func (m errorMessage) appendTo(b []byte) ([]byte, error) {
+	b = append(b, 'd')
+	b = appendString(b, "e")
+	b = append(b, 'l')
+	b = appendInt(b, int64(m.E.Code))
+	b = appendString(b, m.E.Message)
+	b = append(b, 'e')
+	if m.N != "" {
+		b = appendString(b, "n")
+		b = appendString(b, m.N)
+	}
+	b = appendString(b, "t")
+	b = appendString(b, m.T)
+	if m.V != "" {
+		b = appendString(b, "v")
+		b = appendString(b, m.V)
+	}
+	b = appendString(b, "y")
+	b = appendString(b, m.Y)
+	return append(b, 'e'), nil
+}
+
+// replyError 给addr发送一个错误消息，transId是出错的query的transaction ID。
+func (d *DHT) replyError(addr net.UDPAddr, transId string, code int, msg string) {
+	totalSentErrors.Add(1)
+	d.send(addr, errorMessage{T: transId, Y: "e", E: KRPCError{Code: code, Message: msg}})
+}
+
+// processErrorReply 处理别人对我们的query回复的错误。必须在持有d.mu的情况下调用。
+func (d *DHT) processErrorReply(raddr net.UDPAddr, r responseType) {
+	totalRecvErrors.Add(1)
+	recvErrorCodes.Add(strconv.Itoa(r.E.Code), 1)
+	query, ok := d.lookupQuery(r.T, raddr)
+	if !ok {
+		dropPacket(dropUnknownReply)
+		return
+	}
+	node := query.node
+	// 对方还能回复，说明它是可达的，只是不接受这个query。
+	node.lastResponseTime = time.Now()
+	node.failures = 0
+	node.responses++
+	if r.V != "" {
+		node.version = r.V
+	}
+	d.voteExternalAddr(node, r.IP)
+	// 错误回复也通过了标签检查，私有网络中还没有确认的节点可以加入路由表了。
+	d.admitProbe(node)
+	d.queryFailed(node, r.T, query, &r.E)
+}
+
+// queryFailed 结束一个失败的query，并尽快把查找转给另一个节点，而不是等着它超时。
+// 每个查找只重试一次，重试的query再失败就不再重试。必须在持有d.mu的情况下调用。
+func (d *DHT) queryFailed(node *remoteNode, transId string, query *queryType, reason error) {
+	log.V(3).Infof("DHT: %v query to %v failed: %v", query.Type, node.address.String(), reason)
+	d.finishQuery(transId, query)
+	if query.retry {
+		return
+	}
+	var next *queryType
+	switch query.Type {
+	case "get_peers":
+		if d.searchDone(query.ih) {
+			break
+		}
+		if closest := d.routingTable.lookupFiltered(query.ih); len(closest) > 0 {
+			next = d.getPeersFrom(closest[0], query.ih)
+		}
+	case "sample_infohashes":
+		// 爬虫访问的节点不支持BEP 51，改用find_node继续遍历。
+		if query.crawl && reason != errQueryTimeout {
+			next = d.findNodeFrom(node, string(query.ih))
+		}
+	case "find_node":
+		if query.crawl || !d.needMoreNodes() {
+			break
+		}
+		if closest := d.routingTable.lookupFiltered(query.ih); len(closest) > 0 {
+			next = d.findNodeFrom(closest[0], string(query.ih))
+		}
+	}
+	if next != nil {
+		next.retry = true
+		next.crawl = query.crawl
+	} else if query.crawl {
+		d.crawlFinished(node)
+	}
+}
+
+var (
+	totalSentErrors = expvar.NewInt("totalSentErrors")
+	totalRecvErrors = expvar.NewInt("totalRecvErrors")
+	// recvErrorCodes 按错误码统计收到的错误消息。
+	recvErrorCodes = expvar.NewMap("recvErrorCodes")
+)
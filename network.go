@@ -0,0 +1,97 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"expvar"
+	"fmt"
+	"net"
+
+	log "github.com/golang/glog"
+)
+
+/*
+	私有网络。
+	Config.NetworkID不为空时，节点只和NetworkID相同的节点通信，组成一个和公共Mainline DHT隔离的网络。
+	每个消息都带一个"n"字段，内容是从NetworkID算出来的8字节标签，NetworkID本身不会出现在网络上。
+	标签不一致的包(包括公共网络中不带标签的包)在解码之后、进入路由表之前就被丢掉，
+	所以其他网络的节点不会进入routingTable，也就不会被保存到State.Remotes。
+	引导路由器和AddNode()的种子只是地址，不知道属于哪个网络。私有网络中它们先放在d.probes中，
+	第一个通过了标签检查的回复到达时才加入路由表；一直没有回复(例如是公共网络的节点)的在query超时后被丢掉，
+	不会占着路由表的位置直到cleanup。
+	私有网络没有公共的引导路由器，DHTRouters是默认值时会被清空，需要自己用-routers或者AddNode()指定。
+	保存的路由表记录了它属于哪个网络，切换网络后启动时会忽略上次保存的节点。
+	这只是隔离而不是认证：知道标签的人可以加入网络。需要认证时同时设置Config.PSK，见psk.go。
+ */
+
+const defaultDHTRouters = "router.magnets.im:6881,router.bittorrent.com:6881,dht.transmissionbt.com:6881"
+
+const networkTagLen = 8
+
+// networkTag 返回NetworkID对应的标签，公共网络是空字符串。
+func networkTag(networkID string) string {
+	if networkID == "" {
+		return ""
+	}
+	h := sha1.Sum([]byte("dht network:" + networkID))
+	return string(h[:networkTagLen])
+}
+
+// contactNode 返回要联系的addr的节点。公共网络中直接加入路由表；私有网络中除非已经在路由表中，
+// 否则只放在d.probes中，等它回复了带正确标签的包再由admitProbe加入路由表。必须在持有d.mu的情况下调用。
+func (d *DHT) contactNode(addr string) (*remoteNode, error) {
+	if d.networkTag == "" {
+		return d.routingTable.getOrCreateNode("", addr, d.config.UDPProto)
+	}
+	node, hostPort, existed, err := d.routingTable.hostPortToNode(addr, d.config.UDPProto)
+	if err != nil {
+		return nil, err
+	}
+	if existed {
+		return node, nil
+	}
+	if r, ok := d.probes[hostPort]; ok {
+		return r, nil
+	}
+	if len(d.probes) >= d.maxNodes() {
+		return nil, fmt.Errorf("too many unconfirmed nodes")
+	}
+	udpAddr, err := net.ResolveUDPAddr(d.config.UDPProto, hostPort)
+	if err != nil {
+		return nil, err
+	}
+	if d.blocklist.blocked(udpAddr.IP) {
+		return nil, fmt.Errorf("%v is blocklisted", hostPort)
+	}
+	r := newRemoteNode(*udpAddr, "")
+	d.probes[hostPort] = r
+	return r, nil
+}
+
+// admitProbe 在node回复了通过标签检查的包时把它从d.probes移到路由表中。node不是probe或者路由表满了时返回false。
+// 必须在持有d.mu的情况下调用。
+func (d *DHT) admitProbe(node *remoteNode) bool {
+	addr := node.address.String()
+	if d.probes[addr] != node {
+		return false
+	}
+	delete(d.probes, addr)
+	if d.routingTable.length() >= d.maxNodes() {
+		return false
+	}
+	if err := d.routingTable.insert(node, d.config.UDPProto); err != nil {
+		log.V(3).Infof("DHT: admitProbe %v: %v", addr, err)
+		return false
+	}
+	totalAdmittedProbes.Add(1)
+	return true
+}
+
+// dropProbe 在probe的query超时并且没有别的query在等待时丢掉它。必须在持有d.mu的情况下调用。
+func (d *DHT) dropProbe(node *remoteNode) {
+	addr := node.address.String()
+	if d.probes[addr] == node && len(node.pendingQueries) == 0 {
+		delete(d.probes, addr)
+	}
+}
+
+var totalAdmittedProbes = expvar.NewInt("totalAdmittedProbes")
@@ -0,0 +1,58 @@
+package dht
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func startNetworkNode(t *testing.T, networkID string) *DHT {
+	c := NewConfig()
+	c.Address = "127.0.0.1"
+	c.NetworkID = networkID
+	c.DHTRouters = ""
+	c.SaveRoutingTable = false
+	c.QueryTimeout = 200 * time.Millisecond
+	d, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Stop)
+	return d
+}
+
+// 私有网络中的种子只有回复了带正确标签的包才进入路由表，公共网络的节点在query超时后被丢掉。
+func TestPrivateNetworkSeeds(t *testing.T) {
+	a, b, pub := startNetworkNode(t, "corp"), startNetworkNode(t, "corp"), startNetworkNode(t, "")
+	aAddr := fmt.Sprintf("127.0.0.1:%d", a.Port())
+	pubAddr := fmt.Sprintf("127.0.0.1:%d", pub.Port())
+	b.AddNode(aAddr)
+	b.AddNode(pubAddr)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.RLock()
+		_, hasA := b.routingTable.addresses[aAddr]
+		_, hasPub := b.routingTable.addresses[pubAddr]
+		probes := len(b.probes)
+		b.mu.RUnlock()
+		if hasPub {
+			t.Fatal("public node entered the private routing table")
+		}
+		if hasA && probes == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("in table: %v, probes: %d", hasA, probes)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, n := range b.Nodes() {
+		if n.Address != aAddr || !n.Reachable {
+			t.Fatalf("unexpected node %+v", n)
+		}
+	}
+}
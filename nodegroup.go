@@ -0,0 +1,335 @@
+package dht
+
+import (
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+)
+
+/*
+	一个进程运行多个节点。
+	NodeGroup在同一个UDP socket上运行几个ID不同的DHT节点(成员)，例如让更大范围的ID空间离我们近，收到更多的get_peers和announce_peer。
+	每个成员有自己的路由表、transaction、token和主goroutine，共享peerStore、限速(令牌桶、clientThrottle和abuseTracker)、
+	黑名单、外部地址和d.mu，所以同一时间只有一个成员在修改状态。
+	收包和解码由group负责，解码之后把消息分给一个成员：
+	回复和错误按transaction ID找到发送query的成员，transaction ID在整个group中唯一；
+	query交给ID离目标最近的成员，目标是find_node和sample_infohashes的target，get_peers和announce_peer的info_hash，
+	这样get_peers和之后的announce_peer由同一个成员回复，token能对上。ping交给ID离发送者最近的成员。
+	第一个成员使用Config中的Store、DebugAddr和Blocklist，其他成员的ID是随机的，路由表不保存，启动时从第一个成员保存的节点开始。
+	PeersRequestResults和SampleResults也是共用的。total*这些expvar的计数是整个进程的，
+	每个成员自己的计数在expvar "nodeGroupMembers"中，key是成员ID的十六进制，见memberStats()。
+ */
+
+// NodeGroup 应该用NewNodeGroup()来创建。
+type NodeGroup struct {
+	config  Config
+	members []*DHT
+	conn    packetConn
+	arena   arena
+	stop    chan bool
+	wg      sync.WaitGroup
+	// Public channels, shared by all members:
+	PeersRequestResults chan map[InfoHash][]string
+	SampleResults       chan SampleResult
+}
+
+// NewNodeGroup 创建一个有n个成员的NodeGroup，config的意义和New()一样，Config.Workers是收包和解码的goroutine数量。
+func NewNodeGroup(config *Config, n int) (*NodeGroup, error) {
+	if config == nil {
+		config = DefaultConfig
+	}
+	if n < 1 {
+		return nil, errors.New("dht: a NodeGroup needs at least one node")
+	}
+	g := &NodeGroup{stop: make(chan bool)}
+	for i := 0; i < n; i++ {
+		cfg := *config
+		if i > 0 {
+			cfg.Store = NewMemoryStore()
+			cfg.SaveRoutingTable = false
+			cfg.DebugAddr = ""
+			cfg.Blocklist = ""
+		}
+		d, err := New(&cfg)
+		if err != nil {
+			for _, m := range g.members {
+				m.closeStore()
+				groupMemberStats.Delete(hex.EncodeToString([]byte(m.nodeId)))
+			}
+			return nil, err
+		}
+		if i > 0 {
+			d.shareWith(g.members[0])
+		}
+		d.group = g
+		d.inbox = make(chan krpcPacket, 16)
+		d.stats = d.memberStats()
+		g.members = append(g.members, d)
+	}
+	first := g.members[0]
+	g.config = first.config
+	g.arena = newArena(maxUDPPacketSize, arenaSize(g.config.RateLimit))
+	g.PeersRequestResults = first.PeersRequestResults
+	g.SampleResults = first.SampleResults
+	return g, nil
+}
+
+// shareWith 让d使用first的共享资源。必须在d启动之前调用。
+func (d *DHT) shareWith(first *DHT) {
+	d.mu = first.mu
+	d.peerStore = first.peerStore
+	d.throttleMu = first.throttleMu
+	d.clientThrottle = first.clientThrottle
+	d.abuse = first.abuse
+	d.recvBucket = first.recvBucket
+	d.sendBucket = first.sendBucket
+	d.externalAddr = first.externalAddr
+	d.blocklist = first.blocklist
+	d.routingTable.blocklist = first.blocklist
+	d.PeersRequestResults = first.PeersRequestResults
+	d.SampleResults = first.SampleResults
+}
+
+// Members 返回所有成员，第一个是使用Config中Store的那个。
+func (g *NodeGroup) Members() []*DHT {
+	return g.members
+}
+
+// Start 打开socket并启动所有成员。
+func (g *NodeGroup) Start() error {
+	conn, err := openConn(&g.config)
+	if err != nil {
+		return err
+	}
+	g.conn = conn
+	for _, m := range g.members {
+		m.conn = conn
+		m.config.Port = g.config.Port
+	}
+	// 其他成员从第一个成员保存的节点开始，趁它的主goroutine还没有运行时拷贝出来。
+	var seeds []string
+	for addr := range g.members[0].store.Remotes {
+		seeds = append(seeds, addr)
+	}
+
+	workers := g.config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	rawChan := make(chan packetType, workers)
+	for i := 0; i < workers; i++ {
+		g.wg.Add(2)
+		go func() {
+			defer g.wg.Done()
+			readFromSocket(g.conn, rawChan, g.arena, g.config.BlockOnFullArena, g.stop)
+		}()
+		go func() {
+			defer g.wg.Done()
+			g.decodeWorker(rawChan)
+		}()
+	}
+	for i, m := range g.members {
+		if err := m.Start(); err != nil {
+			close(g.stop)
+			g.conn.Close()
+			g.wg.Wait()
+			for _, started := range g.members[:i] {
+				started.Stop()
+			}
+			return err
+		}
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		for _, addr := range seeds {
+			for _, m := range g.members[1:] {
+				select {
+				case m.remoteNodeAcquaintance <- addr:
+				case <-g.stop:
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop 停止所有成员并关闭socket。
+func (g *NodeGroup) Stop() {
+	close(g.stop)
+	if g.conn != nil {
+		g.conn.Close()
+	}
+	g.wg.Wait()
+	for _, m := range g.members {
+		m.Stop()
+		groupMemberStats.Delete(hex.EncodeToString([]byte(m.nodeId)))
+	}
+}
+
+// Port 返回group监听的UDP端口，Start()之前是配置的端口。
+func (g *NodeGroup) Port() int {
+	return g.config.Port
+}
+
+// AddNode 让所有成员都联系addr("host:port")。
+func (g *NodeGroup) AddNode(addr string) {
+	for _, m := range g.members {
+		m.AddNode(addr)
+	}
+}
+
+// PeersRequest 让ID离ih最近的成员查找ih的peer，结果发到PeersRequestResults。
+func (g *NodeGroup) PeersRequest(ih string, announce bool) {
+	g.closest(ih).PeersRequest(ih, announce)
+}
+
+// Search 让ID离ih最近的成员按照opts查找ih的peer。
+func (g *NodeGroup) Search(ih string, opts SearchOptions) {
+	g.closest(ih).Search(ih, opts)
+}
+
+// CancelSearch 停止Search()开始的查找。
+func (g *NodeGroup) CancelSearch(ih string) {
+	g.closest(ih).CancelSearch(ih)
+}
+
+// AddDownload 让ID离ih最近的成员定期查找和宣布ih，见DHT.AddDownload()。
+func (g *NodeGroup) AddDownload(ih string, port int) {
+	g.closest(ih).AddDownload(ih, port)
+}
+
+// RemoveDownload 停止AddDownload()开始的查找和宣布。
+func (g *NodeGroup) RemoveDownload(ih string) {
+	g.closest(ih).RemoveDownload(ih)
+}
+
+// SubscribePeers 订阅ih新发现的peer。ih的查找和别人的announce_peer都由ID离ih最近的成员处理，所以在它上面订阅。
+func (g *NodeGroup) SubscribePeers(ih string) *PeerSubscription {
+	return g.closest(ih).SubscribePeers(ih)
+}
+
+func (g *NodeGroup) decodeWorker(rawChan chan packetType) {
+	first := g.members[0]
+	for {
+		var p packetType
+		select {
+		case p = <-rawChan:
+		case <-g.stop:
+			return
+		}
+		totalRecv.Add(1)
+		r, ok := first.decodePacket(p)
+		g.arena.Push(p.b)
+		if !ok {
+			continue
+		}
+		first.mu.RLock()
+		d := g.route(r, p.raddr)
+		first.mu.RUnlock()
+		replied := d.fastReply(p.raddr, r)
+		select {
+		case d.inbox <- krpcPacket{p.raddr, r, replied}:
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// route 决定由哪个成员处理消息，必须在持有d.mu的读锁的情况下调用。
+func (g *NodeGroup) route(r responseType, raddr net.UDPAddr) *DHT {
+	switch r.Y {
+	case "r", "e":
+		if d := g.replyOwner(r.T, raddr); d != nil {
+			return d
+		}
+	case "q":
+		switch r.Q {
+		case "find_node", "sample_infohashes":
+			return g.closest(r.A.Target)
+		case "get_peers", "announce_peer":
+			return g.closest(string(r.A.InfoHash))
+		default:
+			return g.closest(r.A.Id)
+		}
+	}
+	// 第一个成员会把它当作未知的transaction丢掉并计数。
+	return g.members[0]
+}
+
+// replyOwner 返回发送了transId这个query的成员，必须在持有d.mu的读锁的情况下调用。
+func (g *NodeGroup) replyOwner(transId string, raddr net.UDPAddr) *DHT {
+	for _, m := range g.members {
+		if _, ok := m.lookupQuery(transId, raddr); ok {
+			return m
+		}
+	}
+	return nil
+}
+
+// closest 返回ID离target最近的成员，target不是合法的ID时返回第一个成员。
+func (g *NodeGroup) closest(target string) *DHT {
+	best := g.members[0]
+	if len(target) != nodeIdLen {
+		return best
+	}
+	bestDist := hashDistance(InfoHash(target), InfoHash(best.nodeId))
+	for _, m := range g.members[1:] {
+		if dist := hashDistance(InfoHash(target), InfoHash(m.nodeId)); dist < bestDist {
+			best, bestDist = m, dist
+		}
+	}
+	return best
+}
+
+// isOwnId 判断id是不是我们自己的，包括同一个group中的其他成员。
+func (d *DHT) isOwnId(id string) bool {
+	if id == d.nodeId {
+		return true
+	}
+	if d.group != nil {
+		for _, m := range d.group.members {
+			if m.nodeId == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// groupMemberStats 是所有NodeGroup成员的计数，key是成员ID的十六进制。
+var groupMemberStats = expvar.NewMap("nodeGroupMembers")
+
+// memberStats 创建并发布成员d自己的计数：
+// recv是它处理的消息数，recv_<query>是收到的每种query(不认识的是recv_other)，sent_<query>是发出的每种query，
+// queryTimeouts是超时的query，peers是找到的新peer，nodes是路由表中的节点数。
+func (d *DHT) memberStats() *expvar.Map {
+	m := new(expvar.Map).Init()
+	m.Set("nodes", expvar.Func(func() interface{} {
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		return d.routingTable.length()
+	}))
+	groupMemberStats.Set(hex.EncodeToString([]byte(d.nodeId)), m)
+	return m
+}
+
+// countQuery 统计收到的一个query，不认识的类型都算作recv_other，免得别人发来的任意名字撑大计数表。
+func (d *DHT) countQuery(q string) {
+	switch q {
+	case "ping", "find_node", "get_peers", "announce_peer", "sample_infohashes":
+		d.countStat("recv_"+q, 1)
+	default:
+		d.countStat("recv_other", 1)
+	}
+}
+
+// countStat 给NodeGroup成员自己的计数key加n，不是成员时什么都不做。
+func (d *DHT) countStat(key string, n int64) {
+	if d.stats != nil {
+		d.stats.Add(key, n)
+	}
+}
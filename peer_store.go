@@ -1,136 +1,384 @@
 package dht
 
 import (
-	"container/ring"
+	"encoding/binary"
+	"hash/fnv"
+	"math/bits"
+	"net"
+	"sort"
+	"time"
+
 	"github.com/golang/groupcache/lru"
 	log "github.com/golang/glog"
 )
 
-// For the inner map,key地址是二进制格式，value=ignored
+/*
+	peer的元数据。
+	每个peer记录第一次和最后一次见到的时间、大约有多少个不同的节点在get_peers的回复中给过它、它是不是自己向我们announce_peer的。
+	BEP 5建议peer信息只保留30分钟，所以超过peerTTL没有再次见到的peer会被删除：主goroutine在next()、count()和cleanup时删除，
+	只读的快照只是跳过它们。
+	next()返回的peer一半是排名最高的(见better)，另一半在其余的peer中轮换，这样好的peer总会被返回，其他的peer也有机会。
+	集合满了的时候先删除死了的peer，再删除排名最低的。
+
+	紧凑存储。
+	每个infohash的peer不再用map和ring保存，而是两块连续的内存(slab)：IPv4的记录是6字节的地址，IPv6是18字节，
+	后面都跟着peerMetaLen字节的元数据：
+		firstSeen(uint32，Unix秒) | lastSeen(uint32) | 来源的位图(uint32) | 标志(1字节)
+	来源是节点地址哈希之后在32位的位图中置一位，不同来源的数量是置位的个数，在maxPeerSources以内基本准确。
+	删除记录时把最后一条记录挪过来，slab太空的时候缩小。
+	peerStore记录所有slab的容量加上每个infohash估计的固定开销(infoHashOverhead)，总数超过Config.PeerStoreBytes时，
+	从最久没有用过的infohash开始删除。Config.MaxInfoHashes不为0时仍然限制infohash的数量。
+ */
+
+const (
+	peerTTL        = 30 * time.Minute // 没有再次见到的peer保留多久
+	maxPeerSources = 8                // 来源数最多报告到这么多
+
+	v4PeerLen   = 6
+	v6PeerLen   = 18
+	peerMetaLen = 13
+	// infoHashOverhead 粗略估计每个infohash除了slab以外的内存：peerContactsSet、LRU的链表节点和map项、index的map项和key。
+	infoHashOverhead = 256
+
+	peerFlagAnnounced = 1 << 0
+	peerFlagDead      = 1 << 1
+)
+
+// peerInfo 是一个peer的元数据，从slab中解码出来。
+type peerInfo struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+	sources   uint32 // 给过我们这个peer的节点的位图
+	announced bool   // peer自己向我们发送过announce_peer
+	alive     bool   // false表示同一个地址的路由节点已经死了
+}
+
+func (i peerInfo) expired(now time.Time) bool {
+	return now.Sub(i.lastSeen) > peerTTL
+}
+
+// sourceCount 返回大约有多少个不同的节点给过我们这个peer，最多maxPeerSources。
+func (i peerInfo) sourceCount() int {
+	n := bits.OnesCount32(i.sources)
+	if n > maxPeerSources {
+		n = maxPeerSources
+	}
+	return n
+}
+
+// better 判断i是不是比o更值得返回给别人：活着的优先，然后是直接announce的、来源多的、最近见过的。
+func (i peerInfo) better(o peerInfo) bool {
+	if i.alive != o.alive {
+		return i.alive
+	}
+	if i.announced != o.announced {
+		return i.announced
+	}
+	if i.sourceCount() != o.sourceCount() {
+		return i.sourceCount() > o.sourceCount()
+	}
+	return i.lastSeen.After(o.lastSeen)
+}
+
+func sourceBit(source string) uint32 {
+	if source == "" {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(source))
+	return 1 << (h.Sum32() % 32)
+}
+
+func decodePeerMeta(m []byte) peerInfo {
+	return peerInfo{
+		firstSeen: time.Unix(int64(binary.BigEndian.Uint32(m[0:4])), 0),
+		lastSeen:  time.Unix(int64(binary.BigEndian.Uint32(m[4:8])), 0),
+		sources:   binary.BigEndian.Uint32(m[8:12]),
+		announced: m[12]&peerFlagAnnounced != 0,
+		alive:     m[12]&peerFlagDead == 0,
+	}
+}
+
+func encodePeerMeta(m []byte, i peerInfo) {
+	binary.BigEndian.PutUint32(m[0:4], uint32(i.firstSeen.Unix()))
+	binary.BigEndian.PutUint32(m[4:8], uint32(i.lastSeen.Unix()))
+	binary.BigEndian.PutUint32(m[8:12], i.sources)
+	var flags byte
+	if i.announced {
+		flags |= peerFlagAnnounced
+	}
+	if !i.alive {
+		flags |= peerFlagDead
+	}
+	m[12] = flags
+}
+
+// For the slabs,每条记录是二进制格式的地址加上元数据
 type peerContactsSet struct {
-	set map[string]bool
+	v4 []byte
+	v6 []byte
 	// 需要确保不同的peers在不同时间返回
-	ring *ring.Ring
+	cursor int
 }
 
-// next() 返回8个节点联系，如果可能，将来调用会返回一个不同的联系集合
-func (p *peerContactsSet) next() []string {
-	count := kNodes
-	if count > len(p.set){
-		count = len(p.set)
-	}
-	x := make([]string,0,count)
-	xx := make(map[string]bool)
-	for range p.set {
-		nid := p.ring.Move(1).Value.(string)
-		if _,ok := xx[nid];p.set[nid] && !ok {
-			xx[nid] = true
-		}
-		if len(xx) >= count{
-			break
-		}
-	}
-	if len(xx) < count {
-		for range p.set{
-			nid := p.ring.Move(1).Value.(string)
-			if _,ok := xx[nid];ok {
-				continue
-			}
-			if len(xx) >= count {
-				break
+// slab 返回存放长度为n的地址的slab，n不是6或18时返回nil。
+func (p *peerContactsSet) slab(n int) *[]byte {
+	switch n {
+	case v4PeerLen:
+		return &p.v4
+	case v6PeerLen:
+		return &p.v6
+	}
+	return nil
+}
+
+// each 按顺序对每条记录调用fn，fn返回false时停止。
+func (p *peerContactsSet) each(fn func(contact string, meta []byte) bool) {
+	for _, n := range []int{v4PeerLen, v6PeerLen} {
+		s := *p.slab(n)
+		for off := 0; off < len(s); off += n + peerMetaLen {
+			if !fn(string(s[off:off+n]), s[off+n:off+n+peerMetaLen]) {
+				return
 			}
 		}
 	}
-	for id := range xx {
-		x = append(x,id)
+}
+
+// find 返回peerContact的记录的元数据，找不到时返回nil。
+func (p *peerContactsSet) find(peerContact string) []byte {
+	s := p.slab(len(peerContact))
+	if s == nil {
+		return nil
+	}
+	n := len(peerContact)
+	for off := 0; off < len(*s); off += n + peerMetaLen {
+		if string((*s)[off:off+n]) == peerContact {
+			return (*s)[off+n : off+n+peerMetaLen]
+		}
+	}
+	return nil
+}
+
+// remove 删除peerContact的记录，把最后一条记录挪过来。
+func (p *peerContactsSet) remove(peerContact string) {
+	s := p.slab(len(peerContact))
+	if s == nil {
+		return
+	}
+	stride := len(peerContact) + peerMetaLen
+	for off := 0; off < len(*s); off += stride {
+		if string((*s)[off:off+len(peerContact)]) != peerContact {
+			continue
+		}
+		last := len(*s) - stride
+		copy((*s)[off:off+stride], (*s)[last:])
+		*s = (*s)[:last]
+		if cap(*s) > 2*len(*s)+stride {
+			// 空的太多，缩小到正好够用。
+			*s = append([]byte(nil), *s...)
+		}
+		return
+	}
+}
+
+// ranked 返回所有活着并且没有过期的peer，排名高的在前面。
+func (p *peerContactsSet) ranked(now time.Time) []string {
+	var ret []string
+	infos := make(map[string]peerInfo)
+	p.each(func(c string, meta []byte) bool {
+		info := decodePeerMeta(meta)
+		if info.alive && !info.expired(now) {
+			ret = append(ret, c)
+			infos[c] = info
+		}
+		return true
+	})
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := infos[ret[i]], infos[ret[j]]
+		if a.better(b) {
+			return true
+		}
+		if b.better(a) {
+			return false
+		}
+		return ret[i] < ret[j]
+	})
+	return ret
+}
+
+// next() 返回最多8个节点联系，如果可能，将来调用会返回一个不同的联系集合
+func (p *peerContactsSet) next() []string {
+	now := time.Now()
+	p.expire(now)
+	ranked := p.ranked(now)
+	if len(ranked) <= kNodes {
+		return ranked
+	}
+	best := kNodes / 2
+	x := make([]string, 0, kNodes)
+	x = append(x, ranked[:best]...)
+	rest := ranked[best:]
+	for i := 0; len(x) < kNodes; i++ {
+		x = append(x, rest[(p.cursor+i)%len(rest)])
 	}
+	p.cursor = (p.cursor + kNodes - best) % len(rest)
 	return x
 }
 
-// 将一个peerContact添加到infohash联系人集。 peerContact必须是一个二进制编码的联系人地址，其中前四个字节形成IP，最后一个字节是端口。
-// 目前还不支持IPv6地址。不能存储少于6字节的peerContact。
-func (p *peerContactsSet) put(peerContact string) bool {
-	if len(peerContact) < 6 {
-		return  false
+// 将一个peerContact添加到infohash联系人集。 peerContact必须是一个二进制编码的联系人地址，IPv4是6个字节，IPv6是18个字节，最后两个字节是端口。
+// source是给我们这个peer的节点的地址，announced表示peer自己向我们announce_peer。
+// 已经存在的peer只更新元数据。只有新的peer才返回true。
+func (p *peerContactsSet) put(peerContact, source string, announced bool, now time.Time) bool {
+	s := p.slab(len(peerContact))
+	if s == nil {
+		return false
 	}
-	if ok := p.set[peerContact];ok {
+	if meta := p.find(peerContact); meta != nil {
+		info := decodePeerMeta(meta)
+		info.lastSeen = now
+		info.alive = true
+		info.announced = info.announced || announced
+		info.sources |= sourceBit(source)
+		encodePeerMeta(meta, info)
 		return false
 	}
-	p.set[peerContact] = true  			// peerContact是字符串，将peerContactsSet的set集合中Key为peerContact设为true
-	r := &ring.Ring{Value:peerContact}  // peerContact构建一个新的环形链表r
-	if p.ring == nil {					// 如果peerContactsSet的ring为空，设置为r
-		p.ring = r
-	}else{
-		p.ring.Link(r)					// 如果peerContactsSet的ring非空，ring和r不是同一个环形链表，r添加到ring后面
+	stride := len(peerContact) + peerMetaLen
+	if len(*s)+stride > cap(*s) {
+		// 按25%增长而不是翻倍，浪费的内存少一些。
+		grow := len(*s) / 4 / stride * stride
+		if grow < stride {
+			grow = stride
+		}
+		ns := make([]byte, len(*s), len(*s)+grow)
+		copy(ns, *s)
+		*s = ns
 	}
+	*s = append(*s, peerContact...)
+	*s = append(*s, make([]byte, peerMetaLen)...)
+	info := peerInfo{firstSeen: now, lastSeen: now, sources: sourceBit(source), announced: announced, alive: true}
+	encodePeerMeta((*s)[len(*s)-peerMetaLen:], info)
 	return true
 }
 
-// 如果在参数为空的情况下，它会先尝试删除一个死的对等点，然后删除联系人，并删除联系人。
-func (p *peerContactsSet) drop(peerContact string) string {
-	if peerContact == "" {
-		if c := p.dropDead();c != "" {						// 如果有死元素
-			return c										// 返回这个死元素
-		}else {												// 如果没有死元素
-			return p.drop(p.ring.Next().Value.(string))	// 然后从环形链表上拿下一个元素进行删除
+// evict 删除一个peer给新的peer腾地方：优先删除死了的，否则删除排名最低的。返回被删除的peer。
+func (p *peerContactsSet) evict() string {
+	var worst string
+	var worstInfo peerInfo
+	p.each(func(c string, meta []byte) bool {
+		info := decodePeerMeta(meta)
+		if worst == "" || worstInfo.better(info) {
+			worst, worstInfo = c, info
 		}
+		return info.alive
+	})
+	if worst != "" {
+		p.remove(worst)
 	}
-	for i := 0; i < p.ring.Len()+1; i++ {						// 经过上面这样递归删除死元素的操作后，对环形链表进行遍历
-		if p.ring.Move(1).Value.(string) == peerContact {	// 如果环形链表移动一个位置的元素跟peerContact相等
-			dn := p.ring.Unlink(1).Value.(string)			// 从环形链表上删除这个元素
-			delete(p.set, dn)									// 从peerContactsSet的set中删除这个元素
-			return dn											// 返回这个元素
-		}
-	}
-	return ""
+	return worst
 }
-func (p *peerContactsSet) dropDead() string {
-	for i := 0;i < p.ring.Len()+1; i++ {				// 对环形链表进行遍历
-		if !p.set[p.ring.Move(1).Value.(string)] {  // 如果peerContactsSet的set中，Key为某个infohash的Value为false
-			dn := p.ring.Unlink(1).Value.(string)   // 从环形链表上删除这个元素
-			delete(p.set, dn)							// 从peerContactsSet的set中删除这个元素
-			return  dn									// 返回这个死元素
+
+// expire 删除超过peerTTL没有见到的peer，返回删除的数量。
+func (p *peerContactsSet) expire(now time.Time) int {
+	var dead []string
+	p.each(func(c string, meta []byte) bool {
+		if info := decodePeerMeta(meta); info.expired(now) {
+			dead = append(dead, c)
 		}
+		return true
+	})
+	for _, c := range dead {
+		p.remove(c)
 	}
-	return ""
+	return len(dead)
 }
 
 func (p *peerContactsSet) kill(peerContact string) {
-	if ok := p.set[peerContact]; ok {					// 如果在peerContactsSet中找到了peerContact
-		p.set[peerContact] = false						// 将其Value修改成false，在后面进行drop的时候会将其清理出去
+	if meta := p.find(peerContact); meta != nil {	// 如果在peerContactsSet中找到了peerContact
+		meta[12] |= peerFlagDead					// 标记为死了，在后面腾地方的时候会先把它清理出去
 	}
 }
 
 // Size() 对一个infohash，已知的联系人数量
 func (p *peerContactsSet) Size() int {
-	return len(p.set)
+	return len(p.v4)/(v4PeerLen+peerMetaLen) + len(p.v6)/(v6PeerLen+peerMetaLen)
 }
 
+// Alive() 活着并且没有过期的联系人数量
 func (p *peerContactsSet) Alive() int {
+	now := time.Now()
 	var ret int = 0
-	for ih := range p.set {
-		if p.set[ih] {
+	p.each(func(_ string, meta []byte) bool {
+		if info := decodePeerMeta(meta); info.alive && !info.expired(now) {
 			ret++
 		}
-	}
+		return true
+	})
 	return ret
 }
 
+// bytes 返回这个集合占用的内存，包括infoHashOverhead。
+func (p *peerContactsSet) bytes() int {
+	return cap(p.v4) + cap(p.v6) + infoHashOverhead
+}
+
 type peerStore struct {
 	//为infohash缓存对等点。每一个键都是一个infohash，而值是peerContactsSet。
 	infoHashPeers *lru.Cache
+	index map[InfoHash]*peerContactsSet	// 和infoHashPeers的内容一样，读取时不会改变LRU的顺序，给只读的快照用
 	localActiveDownloads map[InfoHash]bool
-	maxInfoHashes int
 	maxInfoHashPeers int
+	maxBytes int 			// 所有集合的bytes()之和的上限，0表示不限制
+	bytes int 				// 所有集合的bytes()之和
+	blocklist *blocklist	// 黑名单中的peer不会被保存，nil表示不拦截
 }
 
-func newPeerStore(maxInfoHashes,maxInfoHashPeers int) *peerStore {
-	return &peerStore{
+// newPeerStore 创建一个peerStore。maxInfoHashes和maxBytes为0表示不限制。
+func newPeerStore(maxInfoHashes,maxInfoHashPeers,maxBytes int) *peerStore {
+	h := &peerStore{
 		infoHashPeers:lru.New(maxInfoHashes),
+		index:make(map[InfoHash]*peerContactsSet),
 		localActiveDownloads:make(map[InfoHash]bool),
-		maxInfoHashes:maxInfoHashes,
 		maxInfoHashPeers:maxInfoHashPeers,
+		maxBytes:maxBytes,
 	}
+	h.infoHashPeers.OnEvicted = func(key lru.Key, value interface{}) {
+		delete(h.index, InfoHash(key.(string)))
+		h.bytes -= value.(*peerContactsSet).bytes()
+	}
+	return h
+}
+
+// add 把ih的peer集合放进LRU缓存和index
+func (h *peerStore) add(ih InfoHash, peers *peerContactsSet) {
+	if _, ok := h.index[ih]; !ok {
+		h.bytes += peers.bytes()
+	}
+	h.infoHashPeers.Add(string(ih), peers)
+	h.index[ih] = peers
+}
+
+// update 在peers被修改之后更新内存统计，before是修改之前的peers.bytes()。
+func (h *peerStore) update(ih InfoHash, peers *peerContactsSet, before int) {
+	if h.index[ih] == peers {
+		h.bytes += peers.bytes() - before
+	}
+}
+
+// trim 从最久没有用过的infohash开始删除，直到内存不超过maxBytes。最后一个infohash总是保留。
+func (h *peerStore) trim() {
+	for h.maxBytes > 0 && h.bytes > h.maxBytes && h.infoHashPeers.Len() > 1 {
+		h.infoHashPeers.RemoveOldest()
+		totalPeerStoreEvictions.Add(1)
+	}
+}
+
+// infoHashes 返回所有有peer的infohash，不改变LRU的顺序
+func (h *peerStore) infoHashes() []InfoHash {
+	ret := make([]InfoHash, 0, len(h.index))
+	for ih := range h.index {
+		ret = append(ret, ih)
+	}
+	return ret
 }
 
 // 从peerStore中，从缓存中把Key为infohash的Value查找出来
@@ -143,12 +391,15 @@ func (h *peerStore) get(ih InfoHash) *peerContactsSet {
 	return contacts
 }
 
-// count shows the number of known peers for the given infohash.
+// count shows the number of known peers for the given infohash. Expired peers are dropped first.
 func (h *peerStore) count(ih InfoHash) int {
 	peers := h.get(ih)
 	if peers == nil {
 		return 0
 	}
+	before := peers.bytes()
+	peers.expire(time.Now())
+	h.update(ih, peers, before)
 	return peers.Size()
 }
 
@@ -160,39 +411,89 @@ func (h *peerStore) alive(ih InfoHash) int {
 	return peers.Alive()
 }
 
-// peerContacts returns a random set of 8 peers for the ih InfoHash.
+// peerContacts returns a set of up to 8 peers for the ih InfoHash, rotating on each call.
 func (h *peerStore) peerContacts(ih InfoHash) []string {
 	peers := h.get(ih)
 	if peers == nil {
 		return nil
 	}
+	before := peers.bytes()
+	defer h.update(ih, peers, before)
 	return peers.next()
 }
 
+// alivePeers 返回ih所有还活着的peer，二进制格式。和peerContacts不同，它不会改变任何状态，也不改变LRU的顺序。
+func (h *peerStore) alivePeers(ih InfoHash) []string {
+	peers := h.index[ih]
+	if peers == nil {
+		return nil
+	}
+	now := time.Now()
+	ret := make([]string, 0, peers.Size())
+	peers.each(func(c string, meta []byte) bool {
+		if info := decodePeerMeta(meta); info.alive && !info.expired(now) {
+			ret = append(ret, c)
+		}
+		return true
+	})
+	return ret
+}
+
+// peerInfos 返回ih所有没有过期的peer和它们的元数据，不改变任何状态。
+func (h *peerStore) peerInfos(ih InfoHash) map[string]peerInfo {
+	peers := h.index[ih]
+	if peers == nil {
+		return nil
+	}
+	now := time.Now()
+	ret := make(map[string]peerInfo, peers.Size())
+	peers.each(func(c string, meta []byte) bool {
+		if info := decodePeerMeta(meta); !info.expired(now) {
+			ret[c] = info
+		}
+		return true
+	})
+	return ret
+}
+
+// expire 删除所有过期的peer，没有peer的infohash也一起删除。返回删除的peer数量。
+func (h *peerStore) expire(now time.Time) int {
+	n := 0
+	for ih, peers := range h.index {
+		before := peers.bytes()
+		n += peers.expire(now)
+		h.update(ih, peers, before)
+		if peers.Size() == 0 && !h.localActiveDownloads[ih] {
+			h.infoHashPeers.Remove(string(ih))
+		}
+	}
+	return n
+}
+
 // addContact() 作为一个提供infohash的对等点，如果联系人已经添加了，返回true。否则false（例如已经存在或无效了）。
-func (h *peerStore) addContact(ih InfoHash, peerContact string) bool {
-	var peers *peerContactsSet
-	p, ok := h.infoHashPeers.Get(string(ih))  // 从LRU缓存中获取infohash的peer节点集合
-	if ok {
-		var okType bool
-		peers, okType = p.(*peerContactsSet)				// 断言
-		if okType && peers != nil {
-			if peers.Size() >= h.maxInfoHashPeers {    		// 如果缓存的peer节点数大于最大的保存数目
-				if _, ok := peers.set[peerContact]; ok { 	// 判断peerContact是否已经在peerContactsSet中，如果在，返回false
-					return false
-				}
-				if peers.drop("") == "" {		// 如果没有死元素，返回false
-					return false
-				}
-			}
-			h.infoHashPeers.Add(string(ih), peers)			// 将 Key=infohash,Value=peerContactsSet的map保存到peerStore中
-			return peers.put(peerContact)					// 将peerContact保存到peerContactsSet中
+// source是给我们这个peer的节点的二进制地址，announced表示peer自己向我们announce_peer。已经存在的peer会更新元数据。
+func (h *peerStore) addContact(ih InfoHash, peerContact, source string, announced bool) bool {
+	if len(peerContact) != v4PeerLen && len(peerContact) != v6PeerLen {
+		return false
+	}
+	if h.blocklist.blocked(net.IP(peerContact[:len(peerContact)-2])) {
+		return false
+	}
+	peers := h.get(ih)			// 从LRU缓存中获取infohash的peer节点集合
+	if peers == nil {
+		peers = &peerContactsSet{}
+		h.add(ih, peers)
+	}
+	before := peers.bytes()
+	if peers.find(peerContact) == nil && peers.Size() >= h.maxInfoHashPeers {	// 如果缓存的peer节点数大于最大的保存数目
+		if peers.evict() == "" {
+			return false
 		}
-		// Bogus peer contacts, reset them.
 	}
-	peers = &peerContactsSet{set: make(map[string]bool)}
-	h.infoHashPeers.Add(string(ih), peers)
-	return peers.put(peerContact)
+	added := peers.put(peerContact, source, announced, time.Now())	// 将peerContact保存到peerContactsSet中
+	h.update(ih, peers, before)
+	h.trim()
+	return added
 }
 
 func (h *peerStore) killContact(peerContact string) {
@@ -210,8 +511,20 @@ func (h *peerStore) addLocalDownload(ih InfoHash) {
 	h.localActiveDownloads[ih] = true
 }
 
+func (h *peerStore) removeLocalDownload(ih InfoHash) {
+	delete(h.localActiveDownloads, ih)
+}
+
 func (h *peerStore) hasLocalDownload(ih InfoHash) bool {
 	_, ok := h.localActiveDownloads[ih]
 	log.V(3).Infof("hasLocalDownload for %x: %v", ih, ok)
 	return ok
-}
\ No newline at end of file
+}
+
+// infoHashBytes 返回ih的peer占用的内存，不改变LRU的顺序。
+func (h *peerStore) infoHashBytes(ih InfoHash) int {
+	if peers := h.index[ih]; peers != nil {
+		return peers.bytes()
+	}
+	return 0
+}
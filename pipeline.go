@@ -0,0 +1,84 @@
+package dht
+
+import (
+	"net"
+)
+
+/*
+	多核处理。
+	Config.Workers大于1时，收包和解码不再在主goroutine中进行：Workers个goroutine并行地从socket读包(readFromSocket)，
+	另外Workers个goroutine并行地检查来源、解码和限速(decodePacket)，解码完就把arena的block还回去。
+	ping和find_node的回复只需要读路由表，所以在解码的goroutine中持有d.mu的读锁直接回复，
+	不需要经过主goroutine。其他消息，包括已经回复过的query(用来更新路由表)，通过msgChan交给主goroutine处理。
+ */
+
+// krpcPacket 是解码之后交给主goroutine的消息。
+type krpcPacket struct {
+	raddr   net.UDPAddr
+	r       responseType
+	replied bool // 收包的goroutine已经回复过了
+}
+
+// startWorkers 启动n个收包和n个解码的goroutine，返回解码后消息的channel。
+func (d *DHT) startWorkers(n int) chan krpcPacket {
+	rawChan := make(chan packetType, n)
+	msgChan := make(chan krpcPacket, n)
+	for i := 0; i < n; i++ {
+		d.wg.Add(2)
+		go func() {
+			defer d.wg.Done()
+			readFromSocket(d.conn, rawChan, d.bytesArena, d.config.BlockOnFullArena, d.stop)
+		}()
+		go func() {
+			defer d.wg.Done()
+			d.decodeWorker(rawChan, msgChan)
+		}()
+	}
+	return msgChan
+}
+
+func (d *DHT) decodeWorker(rawChan chan packetType, msgChan chan krpcPacket) {
+	for {
+		var p packetType
+		select {
+		case p = <-rawChan:
+		case <-d.stop:
+			return
+		}
+		totalRecv.Add(1)
+		r, ok := d.decodePacket(p)
+		d.bytesArena.Push(p.b)
+		if !ok {
+			continue
+		}
+		replied := d.fastReply(p.raddr, r)
+		select {
+		case msgChan <- krpcPacket{p.raddr, r, replied}:
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// fastReply 在解码的goroutine中直接回复ping、find_node和sample_infohashes。如果已经回复了，返回true。
+func (d *DHT) fastReply(raddr net.UDPAddr, r responseType) bool {
+	if r.Y != "q" || bogusId(r.A.Id) {
+		return false
+	}
+	switch r.Q {
+	case "ping":
+		d.replyPing(raddr, r)
+		return true
+	case "find_node":
+		d.mu.RLock()
+		d.replyFindNode(raddr, r)
+		d.mu.RUnlock()
+		return true
+	case "sample_infohashes":
+		d.mu.RLock()
+		d.replySampleInfohashes(raddr, r)
+		d.mu.RUnlock()
+		return true
+	}
+	return false
+}
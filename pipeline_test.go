@@ -0,0 +1,121 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// discardConn 是一个丢掉所有发送的包的packetConn，基准测试只关心收包这一边。
+type discardConn struct{}
+
+func (discardConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {}
+}
+
+func (discardConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	return len(b), nil
+}
+
+func (discardConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (discardConn) Close() error {
+	return nil
+}
+
+// recordedQueries 生成n个来自不同地址的ping、find_node和get_peers，和真实网络中收到的query一样。
+func recordedQueries(tb testing.TB, n int) []packetType {
+	packets := make([]packetType, 0, n)
+	for i := 0; i < n; i++ {
+		q := queryMessage{T: fmt.Sprintf("%04x", i), Y: "q", A: map[string]interface{}{"id": string(randNodeId())}}
+		switch i % 3 {
+		case 0:
+			q.Q = "ping"
+		case 1:
+			q.Q = "find_node"
+			q.A["target"] = string(randNodeId())
+		case 2:
+			q.Q = "get_peers"
+			q.A["info_hash"] = InfoHash(randNodeId())
+		}
+		b, err := q.appendTo(nil)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		addr := net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 6881}
+		packets = append(packets, packetType{b, addr})
+	}
+	return packets
+}
+
+func newBenchNode(tb testing.TB) *DHT {
+	c := NewConfig()
+	c.DHTRouters = ""
+	c.SaveRoutingTable = false
+	c.StoreBackend = StoreMemory
+	c.RateLimit = -1
+	c.SendRateLimit = -1
+	c.ClientPerMinuteLimit = 1 << 30
+	c.SubnetPerMinuteLimit = 0
+	d, err := New(c)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	d.conn = discardConn{}
+	// find_node的回复需要一些节点。
+	for i := 0; i < 2*kNodes; i++ {
+		addr := fmt.Sprintf("192.168.%d.%d:6881", i/256, i%256)
+		if _, err := d.routingTable.getOrCreateNode(string(randNodeId()), addr, "udp4"); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return d
+}
+
+// BenchmarkDecodePipeline 比较一个和多个解码goroutine的吞吐量，多个goroutine只有在有多个CPU时才会更快(用-cpu设置)。
+// 消费者只是读取msgChan，所以测量的是startWorkers中并行的那部分：来源检查、解码和ping/find_node的快速回复。
+func BenchmarkDecodePipeline(b *testing.B) {
+	packets := recordedQueries(b, 1024)
+	workerCounts := []int{1, 4}
+	if n := runtime.GOMAXPROCS(0); n > 4 {
+		workerCounts = append(workerCounts, n)
+	}
+	for _, workers := range workerCounts {
+		b.Run(fmt.Sprintf("Workers=%d", workers), func(b *testing.B) {
+			d := newBenchNode(b)
+			rawChan := make(chan packetType, workers)
+			msgChan := make(chan krpcPacket, workers)
+			var wg sync.WaitGroup
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					d.decodeWorker(rawChan, msgChan)
+				}()
+			}
+			done := make(chan bool)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					<-msgChan
+				}
+				close(done)
+			}()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				p := packets[i%len(packets)]
+				buf := d.bytesArena.Pop()
+				n := copy(buf, p.b)
+				rawChan <- packetType{buf[:n], p.raddr}
+			}
+			<-done
+			b.StopTimer()
+			close(d.stop)
+			wg.Wait()
+		})
+	}
+}
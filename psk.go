@@ -0,0 +1,170 @@
+package dht
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+	预共享密钥(PSK)加密传输。
+	Config.NetworkID只能把网络隔离开，包的内容还是明文。设置了Config.PSK后，每个UDP包都用AES-256-GCM加密和认证：
+
+		nonce(12字节) | 密文 | GCM tag(16字节)
+
+	nonce的前8个字节是发送时间(UnixNano，大端序)，后4个字节是随机数。接收方先验证GCM tag，
+	再拒绝发送时间和本地时间相差超过replayWindow的包，以及replayWindow内已经见过的nonce，这样截获的包不能被重放。
+	所以节点之间的时钟误差不能超过replayWindow。
+	加密层在packetConn这一层，sendMsg和readFromSocket看到的还是明文，只是一个包的明文最多是maxUDPPacketSize-pskOverhead个字节。
+	验证失败的包直接丢掉，不会回复，也不会给发送方记strike，因为源地址可以伪造。
+ */
+
+const (
+	pskNonceLen  = 12
+	pskTagLen    = 16
+	pskOverhead  = pskNonceLen + pskTagLen
+	replayWindow = 2 * time.Minute
+	// maxReplayNonces 限制记住的nonce数量。只有通过认证的包才会被记住，所以没有密钥的人不能把它撑满。
+	maxReplayNonces = 1 << 17
+)
+
+var errReplay = errors.New("psk: replayed or stale packet")
+
+// packetConn 是DHT收发UDP包用的连接，*net.UDPConn实现了这个接口。
+type packetConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// maxPayload 返回conn一个包最多能发送的明文字节数。
+func maxPayload(conn packetConn) int {
+	if _, ok := conn.(*pskConn); ok {
+		return maxUDPPacketSize - pskOverhead
+	}
+	return maxUDPPacketSize
+}
+
+// pskConn 在packetConn上加密和认证每个包。
+type pskConn struct {
+	packetConn
+	aead cipher.AEAD
+	now  func() time.Time
+
+	mu     sync.Mutex
+	seen   map[[pskNonceLen]byte]time.Time // 见过的nonce和它们的过期时间
+	pruned time.Time
+}
+
+// pskKey 从Config.PSK得到AES-256的密钥。
+func pskKey(psk string) []byte {
+	k := sha256.Sum256([]byte("dht psk:" + psk))
+	return k[:]
+}
+
+func newPSKConn(conn packetConn, psk string) (*pskConn, error) {
+	block, err := aes.NewCipher(pskKey(psk))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &pskConn{
+		packetConn: conn,
+		aead:       aead,
+		now:        time.Now,
+		seen:       make(map[[pskNonceLen]byte]time.Time),
+	}, nil
+}
+
+func (c *pskConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if len(b)+pskOverhead > maxUDPPacketSize {
+		return 0, ErrPacketTooLarge
+	}
+	out := make([]byte, pskNonceLen, len(b)+pskOverhead)
+	binary.BigEndian.PutUint64(out, uint64(c.now().UnixNano()))
+	if _, err := rand.Read(out[8:pskNonceLen]); err != nil {
+		return 0, err
+	}
+	out = c.aead.Seal(out, out[:pskNonceLen], b, nil)
+	if _, err := c.packetConn.WriteToUDP(out, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFromUDP 读取下一个通过认证的包，把明文放在b的开头。验证失败的包被丢掉，继续读下一个。
+func (c *pskConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		n, addr, err := c.packetConn.ReadFromUDP(b)
+		if err != nil {
+			return n, addr, err
+		}
+		plain, err := c.open(b[:n])
+		if err != nil {
+			if err == errReplay {
+				dropPacket(dropReplay)
+			} else {
+				dropPacket(dropDecrypt)
+			}
+			continue
+		}
+		// 明文是解密到b[pskNonceLen:]中的，挪到开头。
+		return copy(b, plain), addr, nil
+	}
+}
+
+// open 验证并解密一个包，返回的明文和p共享内存。
+func (c *pskConn) open(p []byte) ([]byte, error) {
+	if len(p) < pskOverhead {
+		return nil, ErrSyntax
+	}
+	var nonce [pskNonceLen]byte
+	copy(nonce[:], p)
+	plain, err := c.aead.Open(p[pskNonceLen:pskNonceLen], nonce[:], p[pskNonceLen:], nil)
+	if err != nil {
+		return nil, err
+	}
+	if !c.fresh(nonce) {
+		return nil, errReplay
+	}
+	return plain, nil
+}
+
+// fresh 检查nonce的时间是否在replayWindow内，并且没有见过。
+func (c *pskConn) fresh(nonce [pskNonceLen]byte) bool {
+	now := c.now()
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(nonce[:8])))
+	if sent.Before(now.Add(-replayWindow)) || sent.After(now.Add(replayWindow)) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	if now.Sub(c.pruned) > replayWindow/4 || len(c.seen) >= maxReplayNonces {
+		for n, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, n)
+			}
+		}
+		c.pruned = now
+	}
+	if len(c.seen) >= maxReplayNonces {
+		// 窗口内合法的包太多，宁可丢掉也不能忘记见过的nonce。
+		return false
+	}
+	// 超过sent+replayWindow的包会因为太旧被拒绝，所以之后就不需要再记住这个nonce了。
+	c.seen[nonce] = sent.Add(replayWindow)
+	return true
+}
@@ -0,0 +1,160 @@
+package dht
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"testing"
+	"time"
+)
+
+// memConn 是内存中的packetConn，写到一端的包从另一端读出来。
+type memConn struct {
+	addr *net.UDPAddr
+	in   chan []byte
+	peer *memConn
+}
+
+func newMemConnPair() (*memConn, *memConn) {
+	a := &memConn{addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, in: make(chan []byte, 16)}
+	b := &memConn{addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}, in: make(chan []byte, 16)}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (c *memConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	p, ok := <-c.in
+	if !ok {
+		return 0, nil, errors.New("memConn closed")
+	}
+	return copy(b, p), c.peer.addr, nil
+}
+
+func (c *memConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	c.peer.in <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *memConn) Close() error {
+	close(c.in)
+	return nil
+}
+
+func dropCount(reason string) int64 {
+	if v, ok := droppedPackets.Get(reason).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func mustPSKConn(t *testing.T, conn packetConn, psk string) *pskConn {
+	c, err := newPSKConn(conn, psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// sealed 返回sender加密msg之后在网络上传输的包。
+func sealed(t *testing.T, sender *pskConn, raw *memConn, msg string) []byte {
+	if _, err := sender.WriteToUDP([]byte(msg), raw.peer.addr); err != nil {
+		t.Fatal(err)
+	}
+	return <-raw.peer.in
+}
+
+func TestPSKRoundTrip(t *testing.T) {
+	a, b := newMemConnPair()
+	ca, cb := mustPSKConn(t, a, "secret"), mustPSKConn(t, b, "secret")
+	msg := "d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"
+	if n, err := ca.WriteToUDP([]byte(msg), b.addr); err != nil || n != len(msg) {
+		t.Fatal(n, err)
+	}
+	buf := make([]byte, maxUDPPacketSize)
+	n, addr, err := cb.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != msg || addr.String() != a.addr.String() {
+		t.Fatalf("got %q from %v", buf[:n], addr)
+	}
+	if maxPayload(ca) != maxUDPPacketSize-pskOverhead {
+		t.Fatal("maxPayload", maxPayload(ca))
+	}
+	if _, err := ca.WriteToUDP(make([]byte, maxPayload(ca)+1), b.addr); err != ErrPacketTooLarge {
+		t.Fatal(err)
+	}
+}
+
+// 每个被拒绝的包后面跟着一个正常的包，ReadFromUDP应该跳过前者，返回后者，并按原因计数。
+func TestPSKRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		reason string
+		bad    func(t *testing.T, sender *pskConn, raw *memConn, receiver *pskConn) []byte
+	}{
+		{"replayed nonce", dropReplay, func(t *testing.T, sender *pskConn, raw *memConn, receiver *pskConn) []byte {
+			p := sealed(t, sender, raw, "first")
+			buf := make([]byte, maxUDPPacketSize)
+			receiver.packetConn.(*memConn).in <- append([]byte(nil), p...)
+			if n, _, err := receiver.ReadFromUDP(buf); err != nil || string(buf[:n]) != "first" {
+				t.Fatal(n, err)
+			}
+			return p
+		}},
+		{"stale timestamp", dropReplay, func(t *testing.T, sender *pskConn, raw *memConn, receiver *pskConn) []byte {
+			sender.now = func() time.Time { return time.Now().Add(-replayWindow - time.Second) }
+			defer func() { sender.now = time.Now }()
+			return sealed(t, sender, raw, "old")
+		}},
+		{"future timestamp", dropReplay, func(t *testing.T, sender *pskConn, raw *memConn, receiver *pskConn) []byte {
+			sender.now = func() time.Time { return time.Now().Add(replayWindow + time.Second) }
+			defer func() { sender.now = time.Now }()
+			return sealed(t, sender, raw, "new")
+		}},
+		{"tampered ciphertext", dropDecrypt, func(t *testing.T, sender *pskConn, raw *memConn, receiver *pskConn) []byte {
+			p := sealed(t, sender, raw, "tampered")
+			p[pskNonceLen] ^= 1
+			return p
+		}},
+		{"tampered nonce", dropDecrypt, func(t *testing.T, sender *pskConn, raw *memConn, receiver *pskConn) []byte {
+			p := sealed(t, sender, raw, "tampered")
+			p[pskNonceLen-1] ^= 1
+			return p
+		}},
+		{"wrong key", dropDecrypt, func(t *testing.T, sender *pskConn, raw *memConn, receiver *pskConn) []byte {
+			other := mustPSKConn(t, raw, "other secret")
+			return sealed(t, other, raw, "wrong key")
+		}},
+		{"truncated", dropDecrypt, func(t *testing.T, sender *pskConn, raw *memConn, receiver *pskConn) []byte {
+			return sealed(t, sender, raw, "x")[:pskOverhead-1]
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newMemConnPair()
+			sender, receiver := mustPSKConn(t, a, "secret"), mustPSKConn(t, b, "secret")
+			bad := tt.bad(t, sender, a, receiver)
+			before, total := dropCount(tt.reason), totalDroppedPackets.Value()
+			b.in <- bad
+			if _, err := sender.WriteToUDP([]byte("good"), b.addr); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, maxUDPPacketSize)
+			n, _, err := receiver.ReadFromUDP(buf)
+			if err != nil || string(buf[:n]) != "good" {
+				t.Fatalf("got %q, %v", buf[:n], err)
+			}
+			if got := dropCount(tt.reason) - before; got != 1 {
+				t.Errorf("%s drops: got %d, want 1", tt.reason, got)
+			}
+			if got := totalDroppedPackets.Value() - total; got != 1 {
+				t.Errorf("total drops: got %d, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package dht
+
+import (
+	"encoding/hex"
+	"hash/crc32"
+	"net"
+	"sort"
+	"time"
+)
+
+/*
+	节点质量。
+	以前只看reachable和lastResponseTime，一个回复很慢、经常超时的节点和一个稳定的老节点没有区别。
+	quality()把下面几项合成一个0到1之间的分数，越高越好：
+		回复率    收到的回复数/发出的query数(做了平滑，新节点是0.5)
+		RTT       RTT越小越好，还没有样本时是0.5
+		失败      连续超时的次数，达到maxNodeFailures时是0
+		年龄      在路由表里待得越久越可信，qualityMaxAge之后不再增加
+		BEP 42    节点ID是否和它的IP匹配(http://bittorrent.org/beps/bep_0042.html)，局域网地址不检查
+	lookupFiltered在距离相同的节点中优先返回分数高的，isOK跳过分数太低的节点，
+	cleanup会删除已经发过足够多query但分数仍然很低的节点，邻居满了需要替换时也先替换分数最低的边界节点。
+ */
+
+const (
+	qualityGoodRTT       = 200 * time.Millisecond // RTT等于这个值时RTT分数是0.5
+	qualityMaxAge        = time.Hour
+	minLookupQuality     = 0.2 // 分数低于这个值的节点不会被用来查找
+	minKeepQuality       = 0.3 // 发过minQualitySamples个query后分数还低于这个值的节点会被cleanup删除
+	minQualitySamples    = 5
+	qualityWeightReply   = 0.35
+	qualityWeightRTT     = 0.25
+	qualityWeightFailure = 0.2
+	qualityWeightAge     = 0.1
+	qualityWeightBEP42   = 0.1
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// bep42Valid 检查节点ID的前21位是否和BEP 42根据IP算出来的一致。局域网和本地地址总是返回true。
+func bep42Valid(ip net.IP, id string) bool {
+	if len(id) != nodeIdLen {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return true
+	}
+	var b []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := [...]byte{0x03, 0x0f, 0x3f, 0xff}
+		b = make([]byte, 4)
+		for i := range b {
+			b[i] = ip4[i] & mask[i]
+		}
+	} else if ip6 := ip.To16(); ip6 != nil {
+		mask := [...]byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+		b = make([]byte, 8)
+		for i := range b {
+			b[i] = ip6[i] & mask[i]
+		}
+	} else {
+		return false
+	}
+	b[0] |= (id[19] & 0x7) << 5
+	crc := crc32.Checksum(b, castagnoli)
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) && id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+// quality 返回节点在now时的质量分数，范围是[0,1]。
+func (r *remoteNode) quality(now time.Time) float64 {
+	reply := float64(r.responses+1) / float64(r.queries+2)
+	if reply > 1 {
+		reply = 1
+	}
+	rtt := 0.5
+	if r.rtt > 0 {
+		rtt = 1 / (1 + float64(r.rtt)/float64(qualityGoodRTT))
+	}
+	failure := 1 - float64(r.failures)/maxNodeFailures
+	if failure < 0 {
+		failure = 0
+	}
+	age := 0.0
+	if !r.firstSeen.IsZero() {
+		age = float64(now.Sub(r.firstSeen)) / float64(qualityMaxAge)
+		if age > 1 {
+			age = 1
+		}
+	}
+	bep42 := 0.0
+	if bep42Valid(r.address.IP, r.id) {
+		bep42 = 1
+	}
+	return qualityWeightReply*reply + qualityWeightRTT*rtt + qualityWeightFailure*failure +
+		qualityWeightAge*age + qualityWeightBEP42*bep42
+}
+
+// poor 如果节点已经有足够的样本并且分数仍然低于minKeepQuality，返回true。
+func (r *remoteNode) poor(now time.Time) bool {
+	return r.queries >= minQualitySamples && r.quality(now) < minKeepQuality
+}
+
+// sortByQuality 把nodes按照和target的共同前缀长度从长到短排序，长度相同的按质量从高到低排序。
+// target不是nodeIdLen个字节时commonBits会越界，这时保持原来的顺序。
+func sortByQuality(nodes []*remoteNode, target InfoHash) {
+	if len(target) != nodeIdLen {
+		return
+	}
+	now := time.Now()
+	sort.SliceStable(nodes, func(i, j int) bool {
+		ci, cj := commonBits(string(target), nodes[i].id), commonBits(string(target), nodes[j].id)
+		if ci != cj {
+			return ci > cj
+		}
+		return nodes[i].quality(now) > nodes[j].quality(now)
+	})
+}
+
+// NodeQuality 是一个节点的质量分数和用来计算它的数据，用于调试。
+type NodeQuality struct {
+	Address   string
+	ID        string // 十六进制
+	Score     float64
+	RTT       time.Duration
+	Queries   int
+	Responses int
+	Failures  int
+	Age       time.Duration
+	BEP42     bool
+}
+
+// NodeQualities 返回路由表中所有节点的质量，分数高的在前面。可以在任何goroutine中调用。
+func (d *DHT) NodeQualities() []NodeQuality {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	now := time.Now()
+	ret := make([]NodeQuality, 0, len(d.routingTable.addresses))
+	for addr, n := range d.routingTable.addresses {
+		q := NodeQuality{
+			Address:   addr,
+			ID:        hex.EncodeToString([]byte(n.id)),
+			Score:     n.quality(now),
+			RTT:       n.rtt,
+			Queries:   n.queries,
+			Responses: n.responses,
+			Failures:  n.failures,
+			BEP42:     bep42Valid(n.address.IP, n.id),
+		}
+		if !n.firstSeen.IsZero() {
+			q.Age = now.Sub(n.firstSeen)
+		}
+		ret = append(ret, q)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Score > ret[j].Score })
+	return ret
+}
@@ -0,0 +1,98 @@
+package dht
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+/*
+	令牌桶限速。
+	桶的容量等于每秒的速率，也就是说最多允许一秒钟的突发流量。每个包消耗一个令牌，令牌按照经过的时间补充。
+	为了不让别人主动发来的query挤掉我们自己发出的query的回复，桶里留出一部分令牌(priorityReserve)，
+	只有回复我们pendingQueries的包才能用这部分令牌。这样在被洪水攻击时，我们自己的查找还能继续进行。
+*/
+
+// 桶里为优先级高的包保留的比例
+const priorityReserve = 0.2
+
+type tokenBucket struct {
+	mu      sync.Mutex // 收包的goroutine可能有多个
+	rate    float64    // 每秒补充的令牌数
+	burst   float64    // 桶的容量
+	reserve float64    // 只有优先级高的包才能使用的令牌数
+	tokens  float64
+	last    time.Time
+}
+
+// newTokenBucket 创建一个每秒rate个包的令牌桶。rate为0或负数时返回nil，表示不限速。
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate)
+	return &tokenBucket{
+		rate:    burst,
+		burst:   burst,
+		reserve: float64(int64(burst * priorityReserve)),
+		tokens:  burst,
+		last:    time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last)
+	if elapsed <= 0 {
+		return
+	}
+	b.last = now
+	b.tokens += elapsed.Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// allow 尝试消耗一个令牌。普通的包只能使用reserve以上的令牌，priority为true的包可以把桶用光。
+// nil的桶不限速，总是返回true。
+func (b *tokenBucket) allow(priority bool) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	floor := b.reserve
+	if priority {
+		floor = 0
+	}
+	if b.tokens-1 < floor {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 丢包的原因，作为droppedPackets的key。
+const (
+	dropRateLimit       = "rateLimit"       // 别人主动发来的query超过了RateLimit
+	dropRateLimitReply  = "rateLimitReply"  // 连保留的令牌都用完了，回复也只能丢掉
+	dropSendRateLimit   = "sendRateLimit"   // 发送超过了SendRateLimit
+	dropMalformed       = "malformed"       // bencode解码失败
+	dropUnknownReply    = "unknownReply"    // 回复的transaction ID不在pendingQueries中
+	dropBanned          = "banned"          // 来自被封禁的主机
+	dropBlocklisted     = "blocklisted"     // 来自黑名单中的地址
+	dropArenaFull       = "arenaFull"       // 接收缓冲区用完了
+	dropThrottled       = "throttled"       // 单个IP超过了ClientPerMinuteLimit
+	dropNetworkMismatch = "networkMismatch" // 来自其他网络(Config.NetworkID不同)的包
+	dropSubnetThrottled = "subnetThrottled" // 网段超过了SubnetPerMinuteLimit
+	dropDecrypt         = "decrypt"         // 没有通过PSK认证
+	dropReplay          = "replay"          // 通过了PSK认证，但是太旧或者已经收到过
+)
+
+// dropPacket 统计一个被丢掉的包，totalDroppedPackets是总数，droppedPackets按原因分开计数。
+func dropPacket(reason string) {
+	totalDroppedPackets.Add(1)
+	droppedPackets.Add(reason, 1)
+}
+
+var droppedPackets = expvar.NewMap("droppedPackets")
@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"time"
+)
+
+/*
+	路由器模式(Config.RouterMode)，用来运行一个像router.bittorrent.com那样的引导节点。
+	路由器不保存peer：get_peers只回复节点，announce_peer只检查token然后回复，不记录peer。
+	路由表的目标大小是MaxNodes的routerNodesFactor倍，cleanup的周期是CleanupPeriod的1/routerCleanupDivisor，
+	所以不回复的节点会更快被删除。路由表不够大时，每次cleanup都会向随机的目标做几次find_node，让节点分布在整个ID空间里。
+	新节点向路由器要的是一个起点，而不是离某个ID最近的节点，所以回复的节点一半是离target最近的，
+	另一半从把target的前几位翻转之后得到的区域中各取一个，分布在ID空间的不同位置。
+ */
+
+const (
+	routerNodesFactor    = 20
+	routerCleanupDivisor = 3
+	routerRandomWalks    = 4  // 路由表不够大时，每次cleanup做几次随机的find_node
+	routerSpreadBits     = 16 // 最多翻转target的前这么多位来寻找分散的节点
+)
+
+// maxNodes 返回路由表的目标大小。
+func (d *DHT) maxNodes() int {
+	if d.config.RouterMode {
+		return d.config.MaxNodes * routerNodesFactor
+	}
+	return d.config.MaxNodes
+}
+
+// cleanupPeriod 返回检查节点是否可达的周期。
+func (d *DHT) cleanupPeriod() time.Duration {
+	if d.config.RouterMode {
+		return d.config.CleanupPeriod / routerCleanupDivisor
+	}
+	return d.config.CleanupPeriod
+}
+
+// exploreKeyspace 向几个随机的目标发送find_node，必须在持有d.mu的情况下调用。
+func (d *DHT) exploreKeyspace() {
+	for i := 0; i < routerRandomWalks; i++ {
+		d.findNode(string(randNodeId()))
+	}
+}
+
+// spreadNodes 返回kNodes个分散在ID空间中的可达节点，编码成紧凑的节点字符串。
+// 一半是离target最近的，其余的从target翻转了某一位之后的区域中各取一个。
+func (d *DHT) spreadNodes(target InfoHash) string {
+	seen := make(map[*remoteNode]bool)
+	nodes := make([]byte, 0, kNodes*v4nodeContactLen)
+	add := func(r *remoteNode) bool {
+		if r == nil || seen[r] || !r.reachable || bogusId(r.id) || r.addressBinaryFormat == "" {
+			return false
+		}
+		seen[r] = true
+		nodes = append(nodes, r.id...)
+		nodes = append(nodes, r.addressBinaryFormat...)
+		return true
+	}
+	for _, r := range d.routingTable.lookup(target) {
+		if len(seen) >= kNodes/2 {
+			break
+		}
+		add(r)
+	}
+	far := []byte(target)
+	for bit := 0; bit < routerSpreadBits && len(seen) < kNodes; bit++ {
+		mask := byte(0x80) >> uint(bit%8)
+		far[bit/8] ^= mask
+		for _, r := range d.routingTable.lookup(InfoHash(far)) {
+			if add(r) {
+				break
+			}
+		}
+		far[bit/8] ^= mask
+	}
+	if len(nodes) == 0 {
+		// 刚启动的时候还没有可达的节点，总比什么都不回复好。
+		return d.closestNodesString(target)
+	}
+	return string(nodes)
+}
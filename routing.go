@@ -1,6 +1,10 @@
 package dht
 
-import log "github.com/golang/glog"
+import (
+	"time"
+
+	log "github.com/golang/glog"
+)
 
 /**
 	DHT 路由使用一个二叉树，没有桶
@@ -94,9 +98,10 @@ func (n *nTree) lookup(id InfoHash) []*remoteNode {
 	if n == nil || id == "" {
 		return nil
 	}
-	return n.traverse(id,0,ret,false)
+	return n.traverse(id,0,ret,false,kNodes)
 }
-func (n *nTree) traverse(id InfoHash, i int, ret []*remoteNode, filter bool) []*remoteNode {
+// traverse 按照和id的距离从近到远遍历树，最多收集max个节点。
+func (n *nTree) traverse(id InfoHash, i int, ret []*remoteNode, filter bool, max int) []*remoteNode {
 	if n == nil {
 		return ret
 	}
@@ -108,7 +113,7 @@ func (n *nTree) traverse(id InfoHash, i int, ret []*remoteNode, filter bool) []*
 	if i >= len(id)*8 {
 		return ret
 	}
-	if len(ret) >= kNodes{
+	if len(ret) >= max{
 		return ret
 	}
 	chr := byte(id[i/8])
@@ -121,11 +126,11 @@ func (n *nTree) traverse(id InfoHash, i int, ret []*remoteNode, filter bool) []*
 		left = n.zero
 		right = n.one
 	}
-	ret = left.traverse(id,i+1,ret,filter)
-	if len(ret) >= kNodes{
+	ret = left.traverse(id,i+1,ret,filter,max)
+	if len(ret) >= max{
 		return ret
 	}
-	return right.traverse(id,i+1,ret,filter)
+	return right.traverse(id,i+1,ret,filter,max)
 }
 
 func (n *nTree) isOK(ih InfoHash) bool{
@@ -145,9 +150,25 @@ func (n *nTree) isOK(ih InfoHash) bool{
 	if recent {
 		return false
 	}
+	if r.quality(time.Now()) < minLookupQuality {
+		log.V(4).Infof("DHT: Skipping node %x@%v because of its low quality", r.id, r.address)
+		return false
+	}
 	return true
 }
 
+// depth 返回树的高度，空树是0。
+func (n *nTree) depth() int {
+	if n == nil {
+		return 0
+	}
+	zero, one := n.zero.depth(), n.one.depth()
+	if one > zero {
+		zero = one
+	}
+	return zero + 1
+}
+
 // 如果所有的叶子都是空的，就会把树砍下来，然后删除子节点。
 func (n *nTree) cut(id InfoHash,i int) (cutMe bool) {
 	if n == nil {
@@ -215,10 +236,16 @@ func hashDistance(id1 InfoHash, id2 InfoHash) (distance string) {
 	return ""
 }
 
+// lookupFiltered 返回适合查询ih的kNodes个节点。为了在距离相同的节点中挑选质量好的，会先多收集一倍的候选节点。
 func (n *nTree) lookupFiltered(ih InfoHash) []*remoteNode{
-	ret := make([]*remoteNode,0,kNodes)
+	ret := make([]*remoteNode,0,2*kNodes)
 	if n==nil||ih==""{
 		return nil
 	}
-	return n.traverse(ih,0,ret,true)
+	ret = n.traverse(ih,0,ret,true,2*kNodes)
+	sortByQuality(ret,ih)
+	if len(ret) > kNodes {
+		ret = ret[:kNodes]
+	}
+	return ret
 }
@@ -16,6 +16,7 @@ type routingTable struct {
 	nodeId string					// 节点自己本身的ID
 	boundaryNode *remoteNode		// 跟NodeID距离最远的路由表中的某个节点
 	proximity int					// NodeID跟boundaryNode之间的距离有多少个前缀位
+	blocklist *blocklist			// 黑名单中的节点不能进入路由表，nil表示不拦截
 }
 
 // 构建一个路由表，二叉树是空的，自己NodeID是空的，其他的都是空的
@@ -26,15 +27,16 @@ func newRoutingTable() *routingTable{
 		"",
 		nil,
 		0,
+		nil,
 	}
 }
 
 // hostPortToNode根据指定的hostPort规范在路由表中找到一个节点，它应该是一个UDP地址，形式为“host:port”。
-func (r *routingTable) hostPortToNode(hostPort string,port string) (node *remoteNode,addr string,existed bool,err error) {
+func (r *routingTable) hostPortToNode(hostPort string,proto string) (node *remoteNode,addr string,existed bool,err error) {
 	if hostPort == "" {
 		panic("programing error:hostPortToNode received a nil hostPort")
 	}
-	address,err := net.ResolveIPAddr(port,hostPort)
+	address,err := net.ResolveUDPAddr(proto,hostPort)
 	if err != nil {
 		return nil,"",false,err
 	}
@@ -57,7 +59,7 @@ func (r *routingTable) reachableNodes() (tbl map[string][]byte) {
 	tbl = make(map[string][]byte)
 	for addr ,remoteNode := range r.addresses {
 		if addr == "" {
-			log.V(3).Infof("reachableNodes: found empty address for node %x.", r.id)
+			log.V(3).Infof("reachableNodes: found empty address for node %x.", remoteNode.id)
 			continue
 		}
 		if remoteNode.reachable && len(remoteNode.id) == 20 {
@@ -113,6 +115,9 @@ func (r *routingTable) insert(node *remoteNode,proto string) error {
 	if node.address.IP.IsUnspecified() {
 		return fmt.Errorf("routingTable.insert() got a node with a non-specified IP address")
 	}
+	if r.blocklist.blocked(node.address.IP) {
+		return fmt.Errorf("routingTable.insert() got a blocklisted address %v", node.address.String())
+	}
 	_,addr,existed,err := r.hostPortToNode(node.address.String(),proto)
 	if err != nil {
 		return err
@@ -145,6 +150,9 @@ func (r *routingTable) getOrCreateNode(id string,hostPort string,proto string) (
 	if err != nil {
 		return nil,err
 	}
+	if r.blocklist.blocked(udpAddr.IP) {
+		return nil,fmt.Errorf("getOrCreateNode: %v is blocklisted", addr)
+	}
 	node = newRemoteNode(*udpAddr,id)
 	return node,r.insert(node,proto)
 }
@@ -156,7 +164,8 @@ func (r *routingTable) kill(n *remoteNode,p *peerStore) {
 	if r.boundaryNode != nil && n.id == r.boundaryNode.id {
 		r.resetNeighborhoodBoundary()
 	}
-	p.killContact(nettools.BinaryToDottedPort(n.addressBinaryFormat))
+	// peerStore中的联系人和addressBinaryFormat一样是二进制格式。
+	p.killContact(n.addressBinaryFormat)
 }
 
 func (r *routingTable) resetNeighborhoodBoundary() {
@@ -183,6 +192,11 @@ func (r *routingTable) cleanup(cleanupPeriod time.Duration,p *peerStore) (needPi
 			r.kill(n, p)
 			continue
 		}
+		if n.poor(t0) {
+			log.V(4).Infof("DHT: Node %v has a low quality score %.2f. Deleting", addr, n.quality(t0))
+			r.kill(n, p)
+			continue
+		}
 		if n.reachable{
 			if len(n.pendingQueries) == 0{
 				goto PING
@@ -238,13 +252,25 @@ func (r *routingTable) addNewNeighbor(n *remoteNode, displaceBoundary bool, prot
 		return
 	}
 	if displaceBoundary && r.boundaryNode != nil {
-		r.kill(r.boundaryNode,p)
+		r.kill(r.evictionCandidate(),p)
 	}else{
 		r.resetNeighborhoodBoundary()
 	}
 	log.V(4).Infof("New neighbor added %s with proximity %d", nettools.BinaryToDottedPort(n.addressBinaryFormat), r.proximity)
 }
 
+// evictionCandidate 在和boundaryNode一样远的邻居中，返回质量最差的那个。
+func (r *routingTable) evictionCandidate() *remoteNode {
+	worst := r.boundaryNode
+	now := time.Now()
+	for _,n := range r.lookup(InfoHash(r.nodeId)) {
+		if commonBits(r.nodeId,n.id) == r.proximity && n.quality(now) < worst.quality(now) {
+			worst = n
+		}
+	}
+	return worst
+}
+
 // pingSlowly  ping到需要ping的远程节点，在整个cleanupPeriod期间分发ping信号，避免网络流量的爆发。
 // 其并没有真正发送ping，而是向主goroutine发出信号，在协程中会ping节点，使用pingRequest通道。
 func pingSlowly(pingRequest chan *remoteNode,needPing []*remoteNode,cleanupPeriod time.Duration,stop chan bool) {
@@ -254,7 +280,11 @@ func pingSlowly(pingRequest chan *remoteNode,needPing []*remoteNode,cleanupPerio
 	duration := cleanupPeriod - (1*time.Minute)
 	perPingWait := duration / time.Duration(len(needPing))
 	for _,r := range needPing{
-		pingRequest <- r
+		select {
+		case pingRequest <- r:
+		case <-stop:
+			return
+		}
 		select {
 		case <-time.After(perPingWait):
 		case <-stop:
@@ -276,18 +306,3 @@ var (
 	// 该值是一个带有可到达节点数的指标，在最近一次路由表被持久化到磁盘上。
 	reachableNodes = expvar.NewMap("reachableNodes")
 )
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
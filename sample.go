@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"expvar"
+	"net"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+/*
+	BEP 51: sample_infohashes。
+	向一个节点要它存储的infohash的随机样本，回复里的"samples"是若干个20字节的infohash连在一起，
+	"num"是它一共存储了多少个infohash，"interval"是它希望我们至少间隔多少秒再来要样本。
+	回复同时带有离target最近的节点，和find_node一样。
+	结果通过DHT.SampleResults发出，调用SampleInfoHashes()的一方应该及时读取这个channel，满了时结果会被丢掉。
+	我们也回复别人的sample_infohashes，样本从peerStore中随机选取。
+	http://www.bittorrent.org/beps/bep_0051.html
+ */
+
+const (
+	maxSamples     = 20        // 一个回复最多带这么多个infohash，保证包不会太大
+	sampleInterval = time.Hour // 告诉别人的最小请求间隔
+)
+
+// SampleResult 是一个节点对sample_infohashes的回复。
+type SampleResult struct {
+	From     string // 回复的节点的host:port
+	Samples  []InfoHash
+	Num      int           // 节点存储的infohash总数
+	Interval time.Duration // 节点要求的最小请求间隔
+}
+
+// SampleInfoHashes 向addr("host:port")发送sample_infohashes，结果会发到SampleResults。
+func (d *DHT) SampleInfoHashes(addr string) {
+	d.sampleRequest <- addr
+}
+
+func (d *DHT) sampleFrom(r *remoteNode, target string) *queryType {
+	if r == nil {
+		return nil
+	}
+	totalSentSampleInfohashes.Add(1)
+	ty := "sample_infohashes"
+	transId := d.newQuery(r, ty)
+	r.pendingQueries[transId].ih = InfoHash(target)
+	queryArguments := map[string]interface{}{
+		"id":     d.idFor(r.id),
+		"target": target,
+	}
+	query := queryMessage{T: transId, Y: "q", Q: ty, A: queryArguments}
+	return d.sendQuery(r, query)
+}
+
+// requestSample 处理SampleInfoHashes()的请求，必须在持有d.mu的情况下调用。
+func (d *DHT) requestSample(addr string) {
+	r, err := d.routingTable.getOrCreateNode("", addr, d.config.UDPProto)
+	if err != nil {
+		log.V(3).Infof("DHT: sample_infohashes getOrCreateNode %v: %v", addr, err)
+		return
+	}
+	d.sampleFrom(r, string(randNodeId()))
+}
+
+func (d *DHT) processSampleResults(node *remoteNode, query *queryType, resp responseType) {
+	totalRecvSampleInfohashesReply.Add(1)
+	if len(resp.R.Samples)%nodeIdLen != 0 {
+		log.V(3).Infof("DHT: sample_infohashes from %v with invalid samples length %d", node.address.String(), len(resp.R.Samples))
+		return
+	}
+	res := SampleResult{
+		From:     node.address.String(),
+		Samples:  make([]InfoHash, 0, len(resp.R.Samples)/nodeIdLen),
+		Num:      resp.R.Num,
+		Interval: time.Duration(resp.R.Interval) * time.Second,
+	}
+	for i := 0; i < len(resp.R.Samples); i += nodeIdLen {
+		res.Samples = append(res.Samples, InfoHash(resp.R.Samples[i:i+nodeIdLen]))
+	}
+	if query.crawl {
+		for _, ih := range res.Samples {
+			d.foundInfoHash(ih, node.address)
+		}
+		if res.Interval > crawlRevisit {
+			d.crawler.visited.Add(res.From, time.Now().Add(res.Interval))
+		}
+		d.crawlNodes(node, resp.R.Nodes)
+		return
+	}
+	select {
+	case d.SampleResults <- res:
+	default:
+		totalDroppedResults.Add(1)
+	}
+}
+
+// replySampleInfohashes 回复sample_infohashes，只读取路由表和peerStore，可以在持有读锁的情况下调用。
+func (d *DHT) replySampleInfohashes(addr net.UDPAddr, r responseType) {
+	totalRecvSampleInfohashes.Add(1)
+	if len(r.A.Target) != nodeIdLen {
+		d.replyError(addr, r.T, ErrCodeProtocol, "invalid target")
+		return
+	}
+	samples := make([]byte, 0, maxSamples*nodeIdLen)
+	// map的遍历顺序是随机的，取前maxSamples个就是随机样本。
+	for ih := range d.peerStore.index {
+		if len(samples) >= maxSamples*nodeIdLen {
+			break
+		}
+		if len(ih) != nodeIdLen {
+			continue
+		}
+		samples = append(samples, ih...)
+	}
+	reply := replyMessage{
+		T: r.T,
+		Y: "r",
+		R: map[string]interface{}{
+			"id":       d.idFor(r.A.Id),
+			"interval": int(sampleInterval / time.Second),
+			"nodes":    d.nodesForInfoHash(InfoHash(r.A.Target)),
+			"num":      len(d.peerStore.index),
+			"samples":  string(samples),
+		},
+	}
+	d.send(addr, reply)
+}
+
+var (
+	totalRecvSampleInfohashes      = expvar.NewInt("totalRecvSampleInfohashes")
+	totalSentSampleInfohashes      = expvar.NewInt("totalSentSampleInfohashes")
+	totalRecvSampleInfohashesReply = expvar.NewInt("totalRecvSampleInfohashesReply")
+)
@@ -0,0 +1,215 @@
+package dht
+
+import (
+	"expvar"
+	"math/rand"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+/*
+	每个infohash的查找选项。
+	Search()用SearchOptions开始查找一个infohash的peer，PeersRequest()相当于只设置了Announce的Search()。
+	主goroutine在d.searches中记录每个infohash正在进行的查找，处理get_peers的回复和失败时按照它的选项决定：
+	这一轮找到了TargetPeers个Family的peer，或者这一轮已经超过MaxDuration，就不再向新的节点继续查找；
+	数的是这一轮的回复中的peer，不是peerStore中保存的，因为peer保存的时间比重复查找的间隔长，数peerStore的话重复的查找走一步就会停下，
+	announce_peer也就到不了离infohash最近的节点。没有记录的infohash(例如记录已经被删除)才数peerStore。
+	Announce为true时向回复了token的节点发送announce_peer，端口是Port，ImpliedPort为true时让对方使用我们的UDP源端口(BEP 5)。
+	Repeat不为0时每隔Repeat(加减searchJitter的随机抖动，免得很多查找同时开始)重新开始一轮，直到CancelSearch()；
+	否则记录在MaxDuration(为0时是searchRecordTTL)之后删除。
+	对同一个infohash再次调用Search()会替换它的选项并马上开始新的一轮。
+ */
+
+const (
+	searchCheckPeriod = 5 * time.Second
+	searchRecordTTL   = 10 * time.Minute // 不重复并且没有MaxDuration的查找记录保留多久
+	searchJitter      = 10               // 重复查找的间隔随机加减Repeat的这么多分之一
+)
+
+// AddressFamily 选择查找哪种地址的peer。
+type AddressFamily int
+
+const (
+	FamilyAny AddressFamily = iota
+	FamilyIPv4
+	FamilyIPv6
+)
+
+// SearchOptions 是一个infohash的查找选项，零值表示使用Config中的默认值。
+type SearchOptions struct {
+	TargetPeers int           // 找到这么多个peer之后不再继续查找，0表示Config.NumTargetPeers
+	Announce    bool          // 向回复了token的节点宣布我们也在下载这个infohash
+	Port        int           // announce_peer中的端口，0表示Config.AnnouncePort，它也是0时使用DHT的端口
+	ImpliedPort bool          // announce_peer中设置implied_port，让对方使用我们的UDP源端口，适合在NAT后面使用uTP的客户端
+	Family      AddressFamily // 只统计和报告这种地址的peer
+	MaxDuration time.Duration // 每一轮查找最多持续多久，0表示直到找到TargetPeers个peer
+	Repeat      time.Duration // 不为0时每隔这么长时间重新查找一轮，直到CancelSearch()
+}
+
+type search struct {
+	opts    SearchOptions
+	started time.Time       // 这一轮开始的时间
+	next    time.Time       // Repeat不为0时下一轮开始的时间
+	found   map[string]bool // 这一轮的回复中Family的peer，包括peerStore中已经有的，最多target()个
+	// AddDownload()的查找，找到的peer只发给SubscribePeers()的订阅者，不发到PeersRequestResults，
+	// 只订阅的应用程序可能从来不读PeersRequestResults。
+	background bool
+}
+
+// target 返回这个查找要找的peer数。
+func (s *search) target(numTargetPeers int) int {
+	if s.opts.TargetPeers > 0 {
+		return s.opts.TargetPeers
+	}
+	return numTargetPeers
+}
+
+// newRound 记录新一轮查找的开始时间，并安排下一轮。
+func (s *search) newRound(now time.Time) {
+	s.started = now
+	s.found = make(map[string]bool)
+	if s.opts.Repeat > 0 {
+		s.next = now.Add(jitter(s.opts.Repeat))
+	}
+}
+
+// jitter 返回period随机加减period/searchJitter。
+func jitter(period time.Duration) time.Duration {
+	j := int64(period / searchJitter)
+	if j <= 0 {
+		return period
+	}
+	return period + time.Duration(rand.Int63n(2*j+1)-j)
+}
+
+// Search 开始按照opts查找ih的peer，找到的peer发到PeersRequestResults。
+func (d *DHT) Search(ih string, opts SearchOptions) {
+	d.peersRequest <- ihReq{ih: InfoHash(ih), opts: opts}
+}
+
+// CancelSearch 停止ih的查找，已经发出的query的回复仍然会被处理，但不会再继续查找。
+func (d *DHT) CancelSearch(ih string) {
+	d.peersRequest <- ihReq{ih: InfoHash(ih), cancel: true}
+}
+
+// startSearch 处理Search()、CancelSearch()、PeersRequest()和下载的请求，必须在持有d.mu的情况下调用。
+func (d *DHT) startSearch(req ihReq) {
+	if req.cancel {
+		// RemoveDownload()只取消下载自己的查找，不影响调用者另外用Search()开始的查找。
+		if s := d.searches[req.ih]; s != nil && (!req.download || s.background) {
+			delete(d.searches, req.ih)
+		}
+		if req.download {
+			d.peerStore.removeLocalDownload(req.ih)
+		}
+		return
+	}
+	if len(req.ih) != nodeIdLen {
+		log.V(1).Infof("DHT: ignoring search for invalid infohash %x", req.ih)
+		return
+	}
+	if req.download {
+		d.peerStore.addLocalDownload(req.ih)
+	}
+	s := &search{opts: req.opts, background: req.background}
+	s.newRound(time.Now())
+	d.searches[req.ih] = s
+	d.getPeers(req.ih)
+}
+
+// searchDone 判断ih的查找是否已经找到足够的peer或者超时了，没有记录的infohash使用默认选项。必须在持有d.mu的情况下调用。
+func (d *DHT) searchDone(ih InfoHash) bool {
+	s := d.searches[ih]
+	if s == nil {
+		return d.peerStore.count(ih) >= d.config.NumTargetPeers
+	}
+	if s.opts.MaxDuration > 0 && time.Since(s.started) > s.opts.MaxDuration {
+		return true
+	}
+	return len(s.found) >= s.target(d.config.NumTargetPeers)
+}
+
+// searchFound 记录这一轮的get_peers回复中的一个peer，peer是二进制格式。必须在持有d.mu的情况下调用。
+func (d *DHT) searchFound(ih InfoHash, peerContact string) {
+	s := d.searches[ih]
+	if s == nil || !inFamily(peerContact, s.opts.Family) || len(s.found) >= s.target(d.config.NumTargetPeers) {
+		return
+	}
+	s.found[peerContact] = true
+}
+
+// wantsAnnounce 判断是否应该向回复了token的节点宣布ih。
+func (d *DHT) wantsAnnounce(ih InfoHash) bool {
+	if s := d.searches[ih]; s != nil && s.opts.Announce {
+		return true
+	}
+	return d.peerStore.hasLocalDownload(ih)
+}
+
+// announceArgs 返回宣布ih时使用的端口和是否设置implied_port。
+func (d *DHT) announceArgs(ih InfoHash) (port int, implied bool) {
+	if s := d.searches[ih]; s != nil {
+		port, implied = s.opts.Port, s.opts.ImpliedPort
+	}
+	if port == 0 {
+		port = d.announcePort()
+	}
+	return port, implied
+}
+
+// familyPeers 只保留family的peer，peer是二进制格式。
+func familyPeers(peers []string, family AddressFamily) []string {
+	if family == FamilyAny {
+		return peers
+	}
+	ret := peers[:0]
+	for _, p := range peers {
+		if inFamily(p, family) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// inFamily 判断二进制格式的peer是不是family的地址。
+func inFamily(peerContact string, family AddressFamily) bool {
+	switch family {
+	case FamilyIPv4:
+		return len(peerContact) == v4PeerLen
+	case FamilyIPv6:
+		return len(peerContact) == v6PeerLen
+	}
+	return len(peerContact) == v4PeerLen || len(peerContact) == v6PeerLen
+}
+
+// searchFamily 返回ih的查找要的地址类型。
+func (d *DHT) searchFamily(ih InfoHash) AddressFamily {
+	if s := d.searches[ih]; s != nil {
+		return s.opts.Family
+	}
+	return FamilyAny
+}
+
+// checkSearches 重新开始到时间的重复查找，删除已经结束的查找记录。必须在持有d.mu的情况下调用。
+func (d *DHT) checkSearches(now time.Time) {
+	for ih, s := range d.searches {
+		if s.opts.Repeat > 0 {
+			if !now.Before(s.next) {
+				s.newRound(now)
+				totalSearchRepeats.Add(1)
+				d.getPeers(ih)
+			}
+			continue
+		}
+		ttl := s.opts.MaxDuration
+		if ttl == 0 {
+			ttl = searchRecordTTL
+		}
+		if now.Sub(s.started) > ttl {
+			delete(d.searches, ih)
+		}
+	}
+}
+
+var totalSearchRepeats = expvar.NewInt("totalSearchRepeats")
@@ -0,0 +1,74 @@
+package dht
+
+import (
+	"fmt"
+	"testing"
+)
+
+func newSearchNode(t *testing.T) *DHT {
+	c := NewConfig()
+	c.DHTRouters = ""
+	c.SaveRoutingTable = false
+	d, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Stop)
+	return d
+}
+
+func TestRemoveDownloadKeepsSearch(t *testing.T) {
+	d := newSearchNode(t)
+	ih := InfoHash("dddddddddddddddddddd")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// 调用者另外开始的查找在RemoveDownload()之后继续。
+	d.startSearch(ihReq{ih: ih, opts: SearchOptions{Announce: true, Port: 4321, Repeat: downloadSearchPeriod}, download: true, background: true})
+	d.startSearch(ihReq{ih: ih, opts: SearchOptions{TargetPeers: 10}})
+	d.startSearch(ihReq{ih: ih, download: true, cancel: true})
+	if s := d.searches[ih]; s == nil || s.background || s.opts.TargetPeers != 10 {
+		t.Fatalf("foreground search was cancelled: %+v", s)
+	}
+	if d.peerStore.hasLocalDownload(ih) {
+		t.Fatal("download was not removed")
+	}
+
+	// 下载自己的查找被取消。
+	d.startSearch(ihReq{ih: ih, opts: SearchOptions{Repeat: downloadSearchPeriod}, download: true, background: true})
+	d.startSearch(ihReq{ih: ih, download: true, cancel: true})
+	if s := d.searches[ih]; s != nil {
+		t.Fatalf("download search was not cancelled: %+v", s)
+	}
+
+	// CancelSearch()取消任何查找。
+	d.startSearch(ihReq{ih: ih, opts: SearchOptions{TargetPeers: 10}})
+	d.startSearch(ihReq{ih: ih, cancel: true})
+	if s := d.searches[ih]; s != nil {
+		t.Fatalf("search was not cancelled: %+v", s)
+	}
+}
+
+func TestSearchRejectsShortInfoHash(t *testing.T) {
+	d := newSearchNode(t)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.startSearch(ihReq{ih: InfoHash("short"), download: true})
+	if len(d.searches) != 0 || d.peerStore.hasLocalDownload(InfoHash("short")) {
+		t.Fatal("search for a short infohash was started")
+	}
+	// 有多个候选节点时，按共同前缀排序以前会越界。
+	var nodes []*remoteNode
+	for i, addr := range []string{"10.0.0.1:6881", "10.0.0.2:6881", "10.0.0.3:6881"} {
+		n, err := d.routingTable.getOrCreateNode(fmt.Sprintf("short%015d", i), addr, "udp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, n)
+	}
+	sortByQuality(nodes, InfoHash("short"))
+	d.findNode("short")
+	if len(d.transactions) != 0 {
+		t.Fatal("find_node for a short id was sent")
+	}
+}
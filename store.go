@@ -2,82 +2,216 @@ package dht
 
 import (
 	"os"
-	"strings"
 	"path"
 	"github.com/youtube/vitess/go/vt/log"
 	"fmt"
 	"encoding/json"
 	"io/ioutil"
+	"sync"
 )
 
-// dhtStore 用来持久化保存路由表到磁盘上
-type dhtStore struct {
+// State 是Store保存的节点状态，用来持久化保存路由表到磁盘上。自己实现Store时可以用任何方式编码它，JSON只是内置后端的选择。
+type State struct {
 	Id	[]byte
 	Port	int
 	Remotes	map[string][]byte	// Key:IP,Value:node ID
-	path	string 				// Empty if the store is disabled
+	Network	[]byte	// Remotes所属的网络的标签，公共网络为空，见networkTag
 }
 
-func mkdirStore() string {
-	dir := "var/run/cantontorrent"
-	env := os.Environ()
-	for _,e := range env {
-		if strings.HasPrefix(e,"HOME=") {
-			dir = strings.SplitN(e,"=",2)[1]
-			dir = path.Join(dir,".cantontorrent")
-		}
+// Store 是路由表的持久化后端，Load在启动时读取上次保存的状态，如果什么都没有保存过，返回一个空的State而不是错误。
+// Save保存一个快照，Close释放后端占用的资源。所有的错误都返回给调用者，不会直接结束进程。
+type Store interface {
+	Load() (*State, error)
+	Save(s *State) error
+	Close() error
+}
+
+const (
+	StoreFile   = "file"	// 每个端口一个JSON文件，默认值。
+	StoreMemory = "memory"	// 只保存在内存中，进程退出就没有了。
+	StoreBolt   = "bolt"	// 嵌入式KV数据库(bbolt)，每个端口一个数据库文件。
+)
+
+// defaultStateDir 返回$HOME/.cantontorrent，如果没有HOME，就用相对路径var/run/cantontorrent。
+func defaultStateDir() string {
+	if home := os.Getenv("HOME"); home != "" {
+		return path.Join(home, ".cantontorrent")
+	}
+	return "var/run/cantontorrent"
+}
+
+// mkdirStore 创建状态目录，dir为空时用defaultStateDir()。
+func mkdirStore(dir string) (string, error) {
+	if dir == "" {
+		dir = defaultStateDir()
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", fmt.Errorf("mkdir state dir %v: %v", dir, err)
 	}
-	os.MkdirAll(dir,0750)
-	if s,err := os.Stat(dir);err != nil{
-		log.Fatal("stat config dir",err)
-	}else if !s.IsDir(){
-		log.Fatalf("Dir %v expected directory,got %v",dir,s)
+	if s, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("stat state dir %v: %v", dir, err)
+	} else if !s.IsDir() {
+		return "", fmt.Errorf("state dir %v expected directory, got %v", dir, s.Mode())
 	}
-	return dir
+	return dir, nil
 }
 
-func openStore(port int,enabled bool) (cfg *dhtStore){
-	cfg = &dhtStore{Port:port}
-	if enabled{
-		cfg.path = mkdirStore()
-		p := fmt.Sprintf("%v-%v", path.Join(cfg.path, "dht"), port)
-		f,err := os.Open(p)
-		if err != nil{
-			return cfg
+// openStore 根据配置打开持久化后端并读取上次保存的状态。如果cfg.Store不为nil，就直接用它，它属于调用者，出错时也不关闭。
+func openStore(cfg *Config) (Store, *State, error) {
+	s := cfg.Store
+	if s == nil {
+		var err error
+		if s, err = newStore(cfg); err != nil {
+			return nil, nil, err
 		}
-		defer f.Close()
-		if err = json.NewDecoder(f).Decode(cfg);err != nil {
-			println(err)
+	}
+	c, err := s.Load()
+	if err != nil {
+		if cfg.Store == nil {
+			s.Close()
 		}
+		return nil, nil, err
+	}
+	c.Port = cfg.Port
+	if c.Remotes == nil {
+		c.Remotes = make(map[string][]byte)
 	}
-	return
+	return s, c, nil
 }
 
-func saveStore(s dhtStore){
-	if s.path == "" {
-		return
+func newStore(cfg *Config) (Store, error) {
+	if !cfg.SaveRoutingTable {
+		return NewMemoryStore(), nil
 	}
-	tmp,err := ioutil.TempFile(s.path,"cantontorrent")
-	if err != nil{
-		println("saveStore tempfile:",err)
-		return
+	switch cfg.StoreBackend {
+	case "", StoreFile:
+		return NewFileStore(cfg.StateDir, cfg.Port)
+	case StoreMemory:
+		return NewMemoryStore(), nil
+	case StoreBolt:
+		return NewBoltStore(cfg.StateDir, cfg.Port)
+	}
+	return nil, fmt.Errorf("unknown store backend %q", cfg.StoreBackend)
+}
+
+// fileStore 把状态保存为 <dir>/dht-<port> 的JSON文件，写入时先写临时文件再rename，避免写坏旧文件。
+type fileStore struct {
+	dir  string
+	port int
+}
+
+// NewFileStore 创建一个文件后端，dir为空时使用$HOME/.cantontorrent。
+func NewFileStore(dir string, port int) (Store, error) {
+	dir, err := mkdirStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir, port: port}, nil
+}
+
+func (f *fileStore) filename() string {
+	return fmt.Sprintf("%v-%v", path.Join(f.dir, "dht"), f.port)
+}
+
+func (f *fileStore) Load() (*State, error) {
+	s := &State{Port: f.port}
+	fh, err := os.Open(f.filename())
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	if err = json.NewDecoder(fh).Decode(s); err != nil {
+		// 文件坏了就当作没有保存过，下次Save会覆盖它。
+		log.Warningf("DHT: ignoring corrupt store %v: %v", f.filename(), err)
+		return &State{Port: f.port}, nil
+	}
+	return s, nil
+}
+
+func (f *fileStore) Save(s *State) error {
+	tmp, err := ioutil.TempFile(f.dir, "cantontorrent")
+	if err != nil {
+		return fmt.Errorf("saveStore tempfile: %v", err)
 	}
 	err = json.NewEncoder(tmp).Encode(s)
 	tmp.Close()
-	if err != nil{
-		println("saveStore json encoding:",err)
-	}
-	p := fmt.Sprintf("%v-%v", s.path+"/dht", s.Port)
-	if err := os.Rename(tmp.Name(),p);err != nil {
-		if err := os.Remove(p);err != nil {
-			println("saveStore failed to remove the existing config:",err)
-			return
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("saveStore json encoding: %v", err)
+	}
+	p := f.filename()
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		if err := os.Remove(p); err != nil {
+			os.Remove(tmp.Name())
+			return fmt.Errorf("saveStore failed to remove the existing config: %v", err)
 		}
-		if err := os.Rename(tmp.Name(),p);err != nil{
-			println("saveStore failed to rename file after deleting the original config:",err)
-			return
+		if err := os.Rename(tmp.Name(), p); err != nil {
+			return fmt.Errorf("saveStore failed to rename file after deleting the original config: %v", err)
 		}
-	}else{
-		println("saved DHT routing table to the filesystem.")
 	}
-}
\ No newline at end of file
+	log.V(3).Infof("DHT: saved routing table to %v", p)
+	return nil
+}
+
+func (f *fileStore) Close() error {
+	return nil
+}
+
+// memoryStore 把状态保存在内存中，适合测试或者不需要持久化的容器节点。
+type memoryStore struct {
+	mu sync.Mutex
+	s  []byte
+}
+
+// NewMemoryStore 创建一个只保存在内存中的后端。
+func NewMemoryStore() Store {
+	return &memoryStore{}
+}
+
+func (m *memoryStore) Load() (*State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &State{}
+	if m.s == nil {
+		return s, nil
+	}
+	// 保存的是编码后的副本，调用者修改返回值不会影响已保存的状态。
+	if err := json.Unmarshal(m.s, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (m *memoryStore) Save(s *State) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.s = b
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+// closeStore 关闭newStore创建的后端。Config.Store是调用者提供的，由调用者自己关闭。
+func (d *DHT) closeStore() {
+	if d.config.Store != nil {
+		return
+	}
+	if err := d.storage.Close(); err != nil {
+		log.Warningf("DHT: failed to close store: %v", err)
+	}
+}
+
+func saveStore(st Store, s State) {
+	if err := st.Save(&s); err != nil {
+		log.Warningf("DHT: %v", err)
+	}
+}
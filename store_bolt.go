@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("dht")
+
+// boltStore 把状态保存在嵌入式KV数据库中，每个端口一个数据库文件。
+// bbolt打开文件时会加排他的文件锁，所以同一个目录下的多个节点不能共用一个文件，否则后打开的节点会等到Timeout然后失败。
+type boltStore struct {
+	db  *bolt.DB
+	key []byte
+}
+
+// NewBoltStore 打开(或创建) <dir>/dht-<port>.db，dir为空时使用$HOME/.cantontorrent。
+func NewBoltStore(dir string, port int) (Store, error) {
+	dir, err := mkdirStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	filename := path.Join(dir, fmt.Sprintf("dht-%d.db", port))
+	db, err := bolt.Open(filename, 0640, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		// 超时说明另一个使用同一端口的节点(可能在另一个进程中)正在使用这个文件。
+		return nil, fmt.Errorf("open bolt store %v: %v", filename, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create bolt bucket: %v", err)
+	}
+	return &boltStore{db: db, key: []byte(strconv.Itoa(port))}, nil
+}
+
+func (b *boltStore) Load() (*State, error) {
+	s := &State{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBucket).Get(b.key)
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, s)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load bolt store: %v", err)
+	}
+	return s, nil
+}
+
+func (b *boltStore) Save(s *State) error {
+	v, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("saveStore json encoding: %v", err)
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(b.key, v)
+	})
+}
+
+func (b *boltStore) Close() error {
+	return b.db.Close()
+}
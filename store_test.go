@@ -0,0 +1,201 @@
+package dht
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func testState() *State {
+	return &State{
+		Id:      []byte("abcdefghij0123456789"),
+		Port:    6881,
+		Remotes: map[string][]byte{"10.0.0.1:6881": []byte("mnopqrstuvwxyz123456")},
+		Network: []byte("net"),
+	}
+}
+
+func checkState(t *testing.T, got, want *State) {
+	t.Helper()
+	if !bytes.Equal(got.Id, want.Id) || !bytes.Equal(got.Network, want.Network) || len(got.Remotes) != len(want.Remotes) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for k, v := range want.Remotes {
+		if !bytes.Equal(got.Remotes[k], v) {
+			t.Fatalf("remote %v: got %x, want %x", k, got.Remotes[k], v)
+		}
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		open func(dir string) (Store, error)
+	}{
+		{"file", func(dir string) (Store, error) { return NewFileStore(dir, 6881) }},
+		{"memory", func(dir string) (Store, error) { return NewMemoryStore(), nil }},
+		{"bolt", func(dir string) (Store, error) { return NewBoltStore(dir, 6881) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := tt.open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer st.Close()
+			// 什么都没有保存过时返回空的State。
+			s, err := st.Load()
+			if err != nil || len(s.Id) != 0 || len(s.Remotes) != 0 {
+				t.Fatalf("empty store: %+v, %v", s, err)
+			}
+			want := testState()
+			if err := st.Save(want); err != nil {
+				t.Fatal(err)
+			}
+			got, err := st.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkState(t, got, want)
+			// 修改Load返回的State不影响保存的状态。
+			got.Remotes["10.0.0.2:6881"] = []byte("x")
+			if got, err = st.Load(); err != nil {
+				t.Fatal(err)
+			}
+			checkState(t, got, want)
+		})
+	}
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	st, err := NewFileStore(dir, 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testState()
+	if err := st.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	if st, err = NewFileStore(dir, 6881); err != nil {
+		t.Fatal(err)
+	}
+	got, err := st.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, got, want)
+}
+
+func TestFileStoreCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	st, err := NewFileStore(dir, 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "dht-6881"), []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// 坏掉的文件当作没有保存过，下次Save覆盖它。
+	s, err := st.Load()
+	if err != nil || len(s.Id) != 0 || s.Port != 6881 {
+		t.Fatalf("corrupt file: %+v, %v", s, err)
+	}
+	want := testState()
+	if err := st.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := st.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, got, want)
+}
+
+func TestFileStoreBadDir(t *testing.T) {
+	f := path.Join(t.TempDir(), "file")
+	if err := os.WriteFile(f, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStore(f, 6881); err == nil {
+		t.Fatal("expected an error for a state dir that is a file")
+	}
+}
+
+func TestBoltStoreCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	st, err := NewBoltStore(dir, 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.(*boltStore).db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte("6881"), []byte("{not json"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Load(); err == nil {
+		t.Fatal("expected an error for a corrupt value")
+	}
+	st.Close()
+
+	if err := os.WriteFile(path.Join(dir, "dht-6882.db"), []byte("not a bolt database"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := NewBoltStore(dir, 6882); err == nil {
+		st.Close()
+		t.Fatal("expected an error for a corrupt database file")
+	}
+}
+
+// 同一个目录下不同端口的节点可以同时打开bolt后端。
+func TestBoltStoreSharedDir(t *testing.T) {
+	dir := t.TempDir()
+	a, err := NewBoltStore(dir, 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewBoltStore(dir, 6882)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	want := testState()
+	if err := a.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := b.Load(); err != nil || len(s.Id) != 0 {
+		t.Fatalf("other port: %+v, %v", s, err)
+	}
+}
+
+// closedStore 记录Close()是否被调用过。
+type closedStore struct {
+	Store
+	closed bool
+}
+
+func (c *closedStore) Close() error {
+	c.closed = true
+	return c.Store.Close()
+}
+
+func TestConfigStoreNotClosed(t *testing.T) {
+	st := &closedStore{Store: NewMemoryStore()}
+	c := NewConfig()
+	c.DHTRouters = ""
+	c.Store = st
+	d, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Stop()
+	if st.closed {
+		t.Fatal("Config.Store was closed by the DHT")
+	}
+}
@@ -0,0 +1,116 @@
+package dht
+
+import (
+	"container/heap"
+	"errors"
+	"expvar"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+/*
+	query超时。
+	每发出一个query，都按照目标节点的RTT计算一个截止时间放进最小堆，主goroutine定期取出已经过期的条目。
+	如果这个transaction还在d.transactions中，就认为它超时了：把它移到pastQueries，给节点记一次失败，
+	get_peers和find_node会换一个节点重试一次(见queryFailed)。节点连续失败maxNodeFailures次就从路由表中删除，
+	不需要等到cleanup。已经收到回复的条目在取出时直接跳过，所以回复时不需要从堆里删除。
+ */
+
+const (
+	timeoutCheckPeriod = 500 * time.Millisecond
+	minQueryTimeout    = 500 * time.Millisecond
+	rttTimeoutFactor   = 4 // 已知RTT的节点，截止时间是RTT的这么多倍
+	maxNodeFailures    = 3 // 连续超时这么多次的节点会被删除
+)
+
+type queryTimeout struct {
+	deadline time.Time
+	node     *remoteNode
+	transId  string
+	query    *queryType
+}
+
+// timeoutQueue 是按照deadline排序的最小堆，实现了heap.Interface。
+type timeoutQueue []*queryTimeout
+
+func (q timeoutQueue) Len() int            { return len(q) }
+func (q timeoutQueue) Less(i, j int) bool  { return q[i].deadline.Before(q[j].deadline) }
+func (q timeoutQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *timeoutQueue) Push(x interface{}) { *q = append(*q, x.(*queryTimeout)) }
+func (q *timeoutQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return x
+}
+
+// queryDeadline 根据节点的RTT计算query的超时时间，RTT未知时使用Config.QueryTimeout。
+func (d *DHT) queryDeadline(r *remoteNode) time.Duration {
+	if r.rtt <= 0 {
+		return d.config.QueryTimeout
+	}
+	t := r.rtt * rttTimeoutFactor
+	if t < minQueryTimeout {
+		t = minQueryTimeout
+	}
+	if t > d.config.QueryTimeout {
+		t = d.config.QueryTimeout
+	}
+	return t
+}
+
+// sendQuery 发送一个已经通过newQuery登记过的query，并开始计算它的超时。返回登记的queryType。
+// 因为SendRateLimit或者写socket出错没有发出去的query直接注销，不计时，也不算节点的失败，这时返回nil。
+func (d *DHT) sendQuery(r *remoteNode, query queryMessage) *queryType {
+	q := d.transactions[query.T]
+	if !d.send(r.address, query) {
+		totalUnsentQueries.Add(1)
+		delete(d.transactions, query.T)
+		delete(r.pendingQueries, query.T)
+		d.dropProbe(r)
+		return nil
+	}
+	d.countStat("sent_"+query.Q, 1)
+	if q != nil {
+		q.sent = time.Now()
+		r.queries++
+		heap.Push(&d.timeouts, &queryTimeout{
+			deadline: q.sent.Add(d.queryDeadline(r)),
+			node:     r,
+			transId:  query.T,
+			query:    q,
+		})
+	}
+	return q
+}
+
+// expireQueries 处理所有在now之前过期的query，必须在持有d.mu的情况下调用。
+func (d *DHT) expireQueries(now time.Time) {
+	for len(d.timeouts) > 0 && !d.timeouts[0].deadline.After(now) {
+		t := heap.Pop(&d.timeouts).(*queryTimeout)
+		if q, ok := d.transactions[t.transId]; !ok || q != t.query {
+			// 已经收到回复了，或者transaction ID已经被重新使用了。
+			continue
+		}
+		totalQueryTimeouts.Add(1)
+		d.countStat("queryTimeouts", 1)
+		t.node.failures++
+		d.queryFailed(t.node, t.transId, t.query, errQueryTimeout)
+		d.dropProbe(t.node)
+		if t.node.failures >= maxNodeFailures {
+			if _, ok := d.routingTable.addresses[t.node.address.String()]; ok {
+				log.V(4).Infof("DHT: node %v timed out %d times in a row. Deleting", t.node.address.String(), t.node.failures)
+				d.routingTable.kill(t.node, d.peerStore)
+			}
+		}
+	}
+}
+
+var (
+	errQueryTimeout    = errors.New("query timed out")
+	totalQueryTimeouts = expvar.NewInt("totalQueryTimeouts")
+	totalUnsentQueries = expvar.NewInt("totalUnsentQueries")
+)
@@ -0,0 +1,121 @@
+package dht
+
+import (
+	"crypto/rand"
+	"net"
+	"sort"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+/*
+	transaction ID。
+	以前每个remoteNode自己用0-255的十进制字符串做transaction ID，很容易被猜到，也很快就会重复。
+	现在由DHT统一分配随机的紧凑ID(至少transIdLen个字节)，保证和所有还没有结束的query都不冲突。
+	d.transactions把ID映射到queryType，里面记录了发送的节点和时间，收到回复时就能得到这个节点的RTT样本。
+	节点自己的pendingQueries和pastQueries还保留着，用来判断节点是否最近被联系过。
+ */
+
+const (
+	transIdLen     = 2  // 新ID的最小字节数
+	maxPastQueries = 32 // 每个节点保留的已结束query数量
+)
+
+func newTransactionId(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Warningf("DHT: failed to generate random transaction ID: %v", err)
+	}
+	return string(b)
+}
+
+// newQuery 分配一个新的transaction ID，并在d.transactions和r.pendingQueries中登记一个query。
+// 除了类型之外它不设置其他信息，调用者需要自己设置ih等字段。必须在持有d.mu的情况下调用。
+func (d *DHT) newQuery(r *remoteNode, transType string) (transId string) {
+	n := transIdLen
+	for i := 1; ; i++ {
+		transId = newTransactionId(n)
+		if !d.transactionInUse(transId) {
+			break
+		}
+		// 冲突太多说明ID空间快用完了，换更长的ID。
+		if i%8 == 0 {
+			n++
+		}
+	}
+	q := &queryType{Type: transType, node: r}
+	d.transactions[transId] = q
+	r.pendingQueries[transId] = q
+	return transId
+}
+
+// transactionInUse 判断transId是否已经被使用了。NodeGroup的成员共用一个socket，ID必须在整个group中唯一，
+// 收到回复时才能知道是哪个成员发送的query。
+func (d *DHT) transactionInUse(transId string) bool {
+	if d.group == nil {
+		_, ok := d.transactions[transId]
+		return ok
+	}
+	for _, m := range d.group.members {
+		if _, ok := m.transactions[transId]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupQuery 找到transId对应的query，回复必须来自我们发送query的地址。
+func (d *DHT) lookupQuery(transId string, raddr net.UDPAddr) (*queryType, bool) {
+	q, ok := d.transactions[transId]
+	if !ok || q.node == nil {
+		return nil, false
+	}
+	if !q.node.address.IP.Equal(raddr.IP) || q.node.address.Port != raddr.Port {
+		return nil, false
+	}
+	return q, true
+}
+
+// finishQuery 结束一个query：从d.transactions中删除，并从节点的pendingQueries移到pastQueries。
+func (d *DHT) finishQuery(transId string, q *queryType) {
+	delete(d.transactions, transId)
+	r := q.node
+	if r == nil {
+		return
+	}
+	delete(r.pendingQueries, transId)
+	r.pastQueries[transId] = q
+	if len(r.pastQueries) > maxPastQueries {
+		r.prunePastQueries(maxPastQueries)
+	}
+}
+
+// prunePastQueries 只保留最近发送的n个已结束query。
+func (r *remoteNode) prunePastQueries(n int) {
+	type entry struct {
+		id   string
+		sent time.Time
+	}
+	entries := make([]entry, 0, len(r.pastQueries))
+	for id, q := range r.pastQueries {
+		entries = append(entries, entry{id, q.sent})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].sent.After(entries[j].sent) })
+	for _, e := range entries[n:] {
+		delete(r.pastQueries, e.id)
+	}
+}
+
+// NodeRTTs 返回路由表中所有已经有RTT样本的节点的平滑RTT，key是节点的"host:port"地址。可以在任何goroutine中调用。
+func (d *DHT) NodeRTTs() map[string]time.Duration {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	ret := make(map[string]time.Duration)
+	for addr, n := range d.routingTable.addresses {
+		if n.rtt > 0 {
+			ret[addr] = n.rtt
+		}
+	}
+	return ret
+}